@@ -0,0 +1,22 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"os"
+)
+
+// Templates and static files are compiled into the binary so it can run from
+// any working directory.
+//
+//go:embed templates static
+var embeddedAssets embed.FS
+
+// assetFS returns the filesystem holding templates/ and static/. An empty dir
+// selects the embedded copy; otherwise the files are served from disk.
+func assetFS(dir string) fs.FS {
+	if dir == "" {
+		return embeddedAssets
+	}
+	return os.DirFS(dir)
+}
@@ -0,0 +1,537 @@
+// Package config loads the server settings. Each setting can come from a JSON
+// file, an environment variable or a command-line flag; flags override
+// environment variables, which override the file, which overrides the
+// defaults.
+//
+// A setting named "cache-duration" is the -cache-duration flag, the
+// GROUPIE_CACHE_DURATION environment variable and the "cache-duration" key of
+// the file. Durations are written as in Go ("90s", "20m") and a file value may
+// be a JSON string or a bare number or boolean. Lists are comma-separated, or
+// a JSON array of strings in the file. The file itself is named by
+// -config or GROUPIE_CONFIG.
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// EnvPrefix starts the name of every environment variable read by Load.
+const EnvPrefix = "GROUPIE_"
+
+// Config holds every setting of the server.
+type Config struct {
+	// HTTP server
+	Host              string
+	Port              int
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	MaxHeaderBytes    int
+	ShutdownTimeout   time.Duration
+
+	// HTTPS
+	TLS          bool
+	TLSCert      string
+	TLSKey       string
+	RedirectPort int
+
+	// Upstream API
+	UpstreamURL       string
+	UpstreamTimeout   time.Duration
+	UpstreamRetries   int
+	UpstreamRateLimit float64
+	UpstreamBurst     int
+	BulkLocations     bool
+	LocationWorkers   int
+
+	// Cross-origin API access
+	CORSOrigins []string
+	CORSMaxAge  time.Duration
+
+	// Per-client rate limits
+	SearchRateLimit float64
+	SearchBurst     int
+	APIRateLimit    float64
+	APIBurst        int
+	TrustedProxies  []string
+
+	// Security headers
+	CSP           string
+	CSPReportOnly bool
+	HSTSMaxAge    time.Duration
+
+	// Artist data cache
+	CacheDuration    time.Duration
+	RefreshInterval  time.Duration
+	ReadyMaxCacheAge time.Duration
+
+	// Logging
+	LogFormat string
+	LogLevel  string
+
+	// Templates and static files
+	AssetsDir string
+	Dev       bool
+
+	// sources records where each setting that is not a default came from.
+	sources map[string]string
+}
+
+// DefaultCSP only runs scripts and styles from this server, the Bootstrap
+// CDN or tags carrying the request's nonce. Artist images come from wherever
+// the upstream API points, so any HTTPS image is allowed.
+const DefaultCSP = "default-src 'self'; " +
+	"script-src 'self' 'nonce-{nonce}' https://cdn.jsdelivr.net; " +
+	"style-src 'self' 'nonce-{nonce}' https://cdn.jsdelivr.net; " +
+	"img-src 'self' https: data:; " +
+	"connect-src 'self'; " +
+	"object-src 'none'; " +
+	"base-uri 'self'; " +
+	"form-action 'self'; " +
+	"frame-ancestors 'none'"
+
+// Default returns the settings used when nothing overrides them.
+func Default() Config {
+	return Config{
+		Port:              8080,
+		ReadHeaderTimeout: 5 * time.Second,
+		ReadTimeout:       10 * time.Second,
+		WriteTimeout:      time.Minute,
+		IdleTimeout:       2 * time.Minute,
+		MaxHeaderBytes:    1 << 20,
+		ShutdownTimeout:   15 * time.Second,
+
+		UpstreamURL:       "https://groupietrackers.herokuapp.com/api",
+		UpstreamTimeout:   20 * time.Second,
+		UpstreamRetries:   2,
+		UpstreamRateLimit: 10,
+		UpstreamBurst:     10,
+		BulkLocations:     true,
+		LocationWorkers:   8,
+
+		CORSMaxAge: 10 * time.Minute,
+
+		SearchRateLimit: 5,
+		SearchBurst:     20,
+		APIRateLimit:    20,
+		APIBurst:        50,
+
+		CSP:        DefaultCSP,
+		HSTSMaxAge: 365 * 24 * time.Hour,
+
+		CacheDuration:    20 * time.Minute,
+		RefreshInterval:  10 * time.Minute,
+		ReadyMaxCacheAge: time.Hour,
+
+		LogFormat: "text",
+		LogLevel:  "info",
+	}
+}
+
+// setting binds one configuration value to its name.
+type setting struct {
+	name  string
+	usage string
+	value value
+}
+
+// settings lists every setting of c, bound to its fields.
+func (c *Config) settings() []setting {
+	return []setting{
+		{"host", "address to listen on (default: all interfaces)", (*stringValue)(&c.Host)},
+		{"port", "port to listen on", (*intValue)(&c.Port)},
+		{"read-header-timeout", "time allowed to read request headers", (*durationValue)(&c.ReadHeaderTimeout)},
+		{"read-timeout", "time allowed to read a whole request", (*durationValue)(&c.ReadTimeout)},
+		{"write-timeout", "time allowed to write a response", (*durationValue)(&c.WriteTimeout)},
+		{"idle-timeout", "how long keep-alive connections stay open while idle", (*durationValue)(&c.IdleTimeout)},
+		{"max-header-bytes", "maximum size of request headers", (*intValue)(&c.MaxHeaderBytes)},
+		{"shutdown-timeout", "time allowed for in-flight requests to finish on shutdown", (*durationValue)(&c.ShutdownTimeout)},
+
+		{"tls", "serve HTTPS and HTTP/2; in dev mode without tls-cert a self-signed certificate is generated", (*boolValue)(&c.TLS)},
+		{"tls-cert", "PEM certificate file for HTTPS", (*stringValue)(&c.TLSCert)},
+		{"tls-key", "PEM private key file for HTTPS", (*stringValue)(&c.TLSKey)},
+		{"redirect-port", "port on which plain HTTP requests are redirected to HTTPS (0 disables)", (*intValue)(&c.RedirectPort)},
+
+		{"upstream-url", "base URL of the artist data API", (*stringValue)(&c.UpstreamURL)},
+		{"upstream-timeout", "time allowed for each upstream request attempt", (*durationValue)(&c.UpstreamTimeout)},
+		{"upstream-retries", "retries of a failed upstream request", (*intValue)(&c.UpstreamRetries)},
+		{"upstream-rate", "upstream requests per second per host (0 disables the limit)", (*floatValue)(&c.UpstreamRateLimit)},
+		{"upstream-burst", "upstream requests allowed in a burst", (*intValue)(&c.UpstreamBurst)},
+		{"bulk-locations", "load locations from the /locations index instead of one request per artist", (*boolValue)(&c.BulkLocations)},
+		{"location-workers", "concurrent per-artist location requests", (*intValue)(&c.LocationWorkers)},
+
+		{"cors-origins", "comma-separated origins allowed to call the API from a browser, or * for any", (*listValue)(&c.CORSOrigins)},
+		{"cors-max-age", "how long browsers may cache a CORS preflight response", (*durationValue)(&c.CORSMaxAge)},
+
+		{"search-rate", "search requests per second per client (0 disables the limit)", (*floatValue)(&c.SearchRateLimit)},
+		{"search-burst", "search requests a client may make in a burst", (*intValue)(&c.SearchBurst)},
+		{"api-rate", "requests per second per client to other routes (0 disables the limit)", (*floatValue)(&c.APIRateLimit)},
+		{"api-burst", "requests a client may make in a burst to other routes", (*intValue)(&c.APIBurst)},
+		{"trusted-proxies", "comma-separated addresses or CIDR blocks whose X-Forwarded-For header identifies the client", (*listValue)(&c.TrustedProxies)},
+
+		{"csp", "Content-Security-Policy of every response, {nonce} standing for a per-request nonce (empty sends none)", (*stringValue)(&c.CSP)},
+		{"csp-report-only", "report Content-Security-Policy violations without blocking them", (*boolValue)(&c.CSPReportOnly)},
+		{"hsts-max-age", "how long browsers must use HTTPS once they have seen it; sent with tls outside dev mode (0 disables)", (*durationValue)(&c.HSTSMaxAge)},
+
+		{"cache-duration", "how long the artist data is served before it is refreshed", (*durationValue)(&c.CacheDuration)},
+		{"refresh-interval", "how often to refresh the artist data in the background (0 only loads it at startup)", (*durationValue)(&c.RefreshInterval)},
+		{"ready-max-cache-age", "artist data age above which /readyz fails", (*durationValue)(&c.ReadyMaxCacheAge)},
+
+		{"log-format", "log output format: text or json", (*stringValue)(&c.LogFormat)},
+		{"log-level", "minimum log level: debug, info, warn or error", (*stringValue)(&c.LogLevel)},
+
+		{"assets", "directory holding templates/ and static/ (default: embedded copy)", (*stringValue)(&c.AssetsDir)},
+		{"dev", "serve assets from disk and re-parse templates when they change", (*boolValue)(&c.Dev)},
+	}
+}
+
+// EnvName returns the environment variable of a setting.
+func EnvName(name string) string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// Load builds the configuration from the defaults, the config file, the
+// environment (read with lookupEnv) and args, the command-line arguments
+// without the program name. It returns flag.ErrHelp when args ask for the
+// usage message.
+func Load(args []string, lookupEnv func(string) (string, bool)) (Config, error) {
+	cfg := Default()
+	cfg.sources = make(map[string]string)
+	settings := cfg.settings()
+
+	// Flags are parsed first, to find the config file, but applied last
+	fs := flag.NewFlagSet("groupie", flag.ContinueOnError)
+	configPath := fs.String("config", "", "JSON file to read settings from (env "+EnvName("config")+")")
+	flagValues := make(map[string]string)
+	for _, s := range settings {
+		fs.Var(&collector{value: s.value, into: flagValues, name: s.name}, s.name, s.usage+" (env "+EnvName(s.name)+")")
+	}
+	if err := fs.Parse(args); err != nil {
+		return Config{}, err
+	}
+	if fs.NArg() > 0 {
+		return Config{}, fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+
+	path := *configPath
+	if path == "" {
+		path, _ = lookupEnv(EnvName("config"))
+	}
+	if path != "" {
+		fileValues, err := readFile(path)
+		if err != nil {
+			return Config{}, err
+		}
+		if err := cfg.apply(settings, fileValues, "file"); err != nil {
+			return Config{}, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+
+	envValues := make(map[string]string)
+	for _, s := range settings {
+		if v, ok := lookupEnv(EnvName(s.name)); ok {
+			envValues[s.name] = v
+		}
+	}
+	if err := cfg.apply(settings, envValues, "env"); err != nil {
+		return Config{}, err
+	}
+	if err := cfg.apply(settings, flagValues, "flag"); err != nil {
+		return Config{}, err
+	}
+
+	// Development works on the files in the source tree unless told otherwise
+	if cfg.Dev && cfg.AssetsDir == "" {
+		cfg.AssetsDir = "."
+	}
+	return cfg, cfg.Validate()
+}
+
+// apply sets the settings named in values, recording source for each.
+func (c *Config) apply(settings []setting, values map[string]string, source string) error {
+	var errs []error
+	for _, s := range settings {
+		v, ok := values[s.name]
+		if !ok {
+			continue
+		}
+		if err := s.value.Set(v); err != nil {
+			name := s.name
+			if source == "env" {
+				name = EnvName(s.name)
+			}
+			errs = append(errs, fmt.Errorf("invalid value %q for %s: %w", v, name, err))
+			continue
+		}
+		c.sources[s.name] = source
+	}
+	return errors.Join(errs...)
+}
+
+// readFile reads a flat JSON object of settings, as strings.
+func readFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading config file: %w", err)
+	}
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("parsing config file %s: %w", path, err)
+	}
+
+	known := make(map[string]bool)
+	for _, s := range (&Config{}).settings() {
+		known[s.name] = true
+	}
+	values := make(map[string]string, len(raw))
+	for name, v := range raw {
+		if !known[name] {
+			return nil, fmt.Errorf("config file %s: unknown setting %q", path, name)
+		}
+		var s string
+		var list []string
+		switch {
+		case json.Unmarshal(v, &s) == nil:
+		case json.Unmarshal(v, &list) == nil:
+			s = strings.Join(list, ",")
+		default:
+			// Numbers and booleans are taken as written
+			s = string(v)
+		}
+		values[name] = s
+	}
+	return values, nil
+}
+
+// Validate reports every setting whose value cannot work.
+func (c Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	check(c.Port >= 0 && c.Port <= 65535, "port must be between 0 and 65535, got %d", c.Port)
+	check(c.ReadHeaderTimeout > 0, "read-header-timeout must be positive")
+	check(c.ReadTimeout >= 0, "read-timeout must not be negative")
+	check(c.WriteTimeout >= 0, "write-timeout must not be negative")
+	check(c.IdleTimeout >= 0, "idle-timeout must not be negative")
+	check(c.MaxHeaderBytes >= 4096, "max-header-bytes must be at least 4096, got %d", c.MaxHeaderBytes)
+	check(c.ShutdownTimeout > 0, "shutdown-timeout must be positive")
+
+	check((c.TLSCert == "") == (c.TLSKey == ""), "tls-cert and tls-key must be set together")
+	check(!c.TLS || c.TLSCert != "" || c.Dev, "tls needs tls-cert and tls-key outside dev mode")
+	check(c.TLS || c.TLSCert == "", "tls-cert and tls-key need tls")
+	check(c.RedirectPort >= 0 && c.RedirectPort <= 65535, "redirect-port must be between 0 and 65535, got %d", c.RedirectPort)
+	check(c.RedirectPort == 0 || c.TLS, "redirect-port needs tls")
+	check(c.RedirectPort == 0 || c.RedirectPort != c.Port, "redirect-port must differ from port")
+
+	u, err := url.Parse(c.UpstreamURL)
+	check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "", "upstream-url must be an absolute http or https URL, got %q", c.UpstreamURL)
+	check(c.UpstreamTimeout > 0, "upstream-timeout must be positive")
+	check(c.UpstreamRetries >= 0, "upstream-retries must not be negative")
+	check(c.UpstreamRateLimit >= 0, "upstream-rate must not be negative")
+	check(c.UpstreamBurst >= 1, "upstream-burst must be at least 1")
+	check(c.LocationWorkers >= 1, "location-workers must be at least 1")
+
+	for _, origin := range c.CORSOrigins {
+		check(validOrigin(origin), "cors-origins must hold * or origins such as http://localhost:3000, got %q", origin)
+	}
+	check(c.CORSMaxAge >= 0, "cors-max-age must not be negative")
+
+	check(c.SearchRateLimit >= 0, "search-rate must not be negative")
+	check(c.SearchBurst >= 1, "search-burst must be at least 1")
+	check(c.APIRateLimit >= 0, "api-rate must not be negative")
+	check(c.APIBurst >= 1, "api-burst must be at least 1")
+	for _, proxy := range c.TrustedProxies {
+		_, err := parsePrefix(proxy)
+		check(err == nil, "trusted-proxies must hold IP addresses or CIDR blocks, got %q", proxy)
+	}
+
+	check(!strings.ContainsAny(c.CSP, "\r\n"), "csp must be a single line")
+	check(c.HSTSMaxAge >= 0, "hsts-max-age must not be negative")
+
+	check(c.CacheDuration > 0, "cache-duration must be positive")
+	check(c.RefreshInterval >= 0, "refresh-interval must not be negative")
+	check(c.ReadyMaxCacheAge >= c.CacheDuration, "ready-max-cache-age (%s) must be at least cache-duration (%s)", c.ReadyMaxCacheAge, c.CacheDuration)
+
+	check(c.LogFormat == "text" || c.LogFormat == "json", "log-format must be text or json, got %q", c.LogFormat)
+	var level slog.Level
+	check(level.UnmarshalText([]byte(c.LogLevel)) == nil, "log-level must be debug, info, warn or error, got %q", c.LogLevel)
+
+	return errors.Join(errs...)
+}
+
+// TrustedProxyPrefixes returns TrustedProxies as address blocks, a bare
+// address being a block of one. Entries Validate rejects are skipped.
+func (c Config) TrustedProxyPrefixes() []netip.Prefix {
+	var prefixes []netip.Prefix
+	for _, proxy := range c.TrustedProxies {
+		if p, err := parsePrefix(proxy); err == nil {
+			prefixes = append(prefixes, p)
+		}
+	}
+	return prefixes
+}
+
+func parsePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		p, err := netip.ParsePrefix(s)
+		return p.Masked(), err
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()), nil
+}
+
+// validOrigin reports whether s is "*" or a scheme, host and optional port
+// with nothing after them, as browsers send in the Origin header.
+func validOrigin(s string) bool {
+	if s == "*" {
+		return true
+	}
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "" &&
+		u.User == nil && u.Path == "" && u.RawQuery == "" && u.Fragment == ""
+}
+
+// Addr returns the address the server listens on.
+func (c Config) Addr() string {
+	return net.JoinHostPort(c.Host, strconv.Itoa(c.Port))
+}
+
+// Source returns where a setting came from: "default", "file", "env" or
+// "flag".
+func (c Config) Source(name string) string {
+	if source, ok := c.sources[name]; ok {
+		return source
+	}
+	return "default"
+}
+
+// LogValue lists every setting with its value and, unless it is the default,
+// where it came from.
+func (c Config) LogValue() slog.Value {
+	var attrs []slog.Attr
+	for _, s := range c.settings() {
+		v := s.value.String()
+		if source := c.Source(s.name); source != "default" {
+			v += " (" + source + ")"
+		}
+		attrs = append(attrs, slog.String(s.name, v))
+	}
+	return slog.GroupValue(attrs...)
+}
+
+// value is a setting that can be parsed from and printed as a string.
+type value interface {
+	Set(string) error
+	String() string
+}
+
+// collector is the flag.Value of a setting. It keeps what was passed on the
+// command line so that it can be applied after the file and environment.
+type collector struct {
+	value value
+	into  map[string]string
+	name  string
+}
+
+func (f *collector) Set(s string) error {
+	f.into[f.name] = s
+	return nil
+}
+
+func (f *collector) String() string {
+	if f == nil || f.value == nil {
+		return ""
+	}
+	return f.value.String()
+}
+
+func (f *collector) IsBoolFlag() bool {
+	_, ok := f.value.(*boolValue)
+	return ok
+}
+
+type stringValue string
+
+func (v *stringValue) Set(s string) error { *v = stringValue(s); return nil }
+func (v *stringValue) String() string     { return string(*v) }
+
+type intValue int
+
+func (v *intValue) Set(s string) error {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return errors.New("not an integer")
+	}
+	*v = intValue(n)
+	return nil
+}
+func (v *intValue) String() string { return strconv.Itoa(int(*v)) }
+
+type floatValue float64
+
+func (v *floatValue) Set(s string) error {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return errors.New("not a number")
+	}
+	*v = floatValue(f)
+	return nil
+}
+func (v *floatValue) String() string { return strconv.FormatFloat(float64(*v), 'g', -1, 64) }
+
+type boolValue bool
+
+func (v *boolValue) Set(s string) error {
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		return errors.New("not a boolean")
+	}
+	*v = boolValue(b)
+	return nil
+}
+func (v *boolValue) String() string { return strconv.FormatBool(bool(*v)) }
+
+type durationValue time.Duration
+
+func (v *durationValue) Set(s string) error {
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return errors.New("not a duration such as 30s or 20m")
+	}
+	*v = durationValue(d)
+	return nil
+}
+func (v *durationValue) String() string { return time.Duration(*v).String() }
+
+// listValue is a comma-separated list. Empty items are dropped.
+type listValue []string
+
+func (v *listValue) Set(s string) error {
+	*v = nil
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*v = append(*v, item)
+		}
+	}
+	return nil
+}
+func (v *listValue) String() string { return strings.Join(*v, ",") }
@@ -0,0 +1,214 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// env returns a lookupEnv reading from vars.
+func env(vars map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		v, ok := vars[name]
+		return v, ok
+	}
+}
+
+func writeConfigFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "groupie.json")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestDefaultIsValid(t *testing.T) {
+	if err := Default().Validate(); err != nil {
+		t.Errorf("default configuration is invalid: %v", err)
+	}
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	file := writeConfigFile(t, `{"port": 9000, "host": "127.0.0.1", "cache-duration": "5m", "dev": true, "upstream-rate": 2.5}`)
+
+	tests := []struct {
+		name       string
+		args       []string
+		env        map[string]string
+		wantPort   int
+		wantSource string
+	}{
+		{name: "Default", wantPort: 8080, wantSource: "default"},
+		{name: "File", args: []string{"-config", file}, wantPort: 9000, wantSource: "file"},
+		{name: "File named by env", env: map[string]string{"GROUPIE_CONFIG": file}, wantPort: 9000, wantSource: "file"},
+		{name: "Env over file", args: []string{"-config", file}, env: map[string]string{"GROUPIE_PORT": "9001"}, wantPort: 9001, wantSource: "env"},
+		{name: "Flag over env", args: []string{"-config", file, "-port", "9002"}, env: map[string]string{"GROUPIE_PORT": "9001"}, wantPort: 9002, wantSource: "flag"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := Load(tt.args, env(tt.env))
+			if err != nil {
+				t.Fatalf("Load returned %v", err)
+			}
+			if cfg.Port != tt.wantPort || cfg.Source("port") != tt.wantSource {
+				t.Errorf("port = %d from %s, want %d from %s", cfg.Port, cfg.Source("port"), tt.wantPort, tt.wantSource)
+			}
+		})
+	}
+
+	// Settings only the file sets keep their file values
+	cfg, err := Load([]string{"-config", file, "-port", "9002"}, env(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Host != "127.0.0.1" || cfg.CacheDuration != 5*time.Minute || !cfg.Dev || cfg.UpstreamRateLimit != 2.5 {
+		t.Errorf("file values were not applied: %+v", cfg)
+	}
+	if cfg.Addr() != "127.0.0.1:9002" {
+		t.Errorf("Addr() = %q", cfg.Addr())
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		env     map[string]string
+		file    string
+		wantErr string
+	}{
+		{name: "Unknown flag", args: []string{"-colour", "blue"}, wantErr: "flag provided but not defined"},
+		{name: "Stray argument", args: []string{"serve"}, wantErr: "unexpected arguments: serve"},
+		{name: "Bad flag value", args: []string{"-port", "http"}, wantErr: `invalid value "http" for port: not an integer`},
+		{name: "Bad env value", env: map[string]string{"GROUPIE_CACHE_DURATION": "20"}, wantErr: `invalid value "20" for GROUPIE_CACHE_DURATION`},
+		{name: "Missing file", args: []string{"-config", "/no/such/file.json"}, wantErr: "reading config file"},
+		{name: "Malformed file", file: `{"port": }`, wantErr: "parsing config file"},
+		{name: "Unknown file setting", file: `{"prot": 8080}`, wantErr: `unknown setting "prot"`},
+		{name: "Bad file value", file: `{"dev": "sometimes"}`, wantErr: `invalid value "sometimes" for dev`},
+		{name: "Port out of range", args: []string{"-port", "70000"}, wantErr: "port must be between 0 and 65535"},
+		{name: "Relative upstream URL", env: map[string]string{"GROUPIE_UPSTREAM_URL": "/api"}, wantErr: "upstream-url must be an absolute http or https URL"},
+		{name: "Unknown log level", args: []string{"-log-level", "loud"}, wantErr: "log-level must be debug, info, warn or error"},
+		{name: "TLS without a certificate", args: []string{"-tls"}, wantErr: "tls needs tls-cert and tls-key outside dev mode"},
+		{name: "Certificate without key", args: []string{"-tls", "-tls-cert", "cert.pem"}, wantErr: "tls-cert and tls-key must be set together"},
+		{name: "Certificate without TLS", args: []string{"-tls-cert", "cert.pem", "-tls-key", "key.pem"}, wantErr: "tls-cert and tls-key need tls"},
+		{name: "Redirect without TLS", args: []string{"-redirect-port", "8081"}, wantErr: "redirect-port needs tls"},
+		{name: "Redirect on the HTTPS port", args: []string{"-dev", "-tls", "-redirect-port", "8080"}, wantErr: "redirect-port must differ from port"},
+		{name: "Origin with a path", env: map[string]string{"GROUPIE_CORS_ORIGINS": "http://localhost:3000/app"}, wantErr: `cors-origins must hold * or origins such as http://localhost:3000, got "http://localhost:3000/app"`},
+		{name: "Origin without a scheme", args: []string{"-cors-origins", "localhost:3000"}, wantErr: "cors-origins must hold"},
+		{name: "Bad trusted proxy", args: []string{"-trusted-proxies", "10.0.0.0/8,proxy.local"}, wantErr: `trusted-proxies must hold IP addresses or CIDR blocks, got "proxy.local"`},
+		{name: "Zero search burst", args: []string{"-search-burst", "0"}, wantErr: "search-burst must be at least 1"},
+		{name: "Multi-line CSP", env: map[string]string{"GROUPIE_CSP": "default-src 'self';\nscript-src 'self'"}, wantErr: "csp must be a single line"},
+		{name: "Readiness shorter than cache", args: []string{"-cache-duration", "2h"}, wantErr: "ready-max-cache-age (1h0m0s) must be at least cache-duration (2h0m0s)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := tt.args
+			if tt.file != "" {
+				args = append([]string{"-config", writeConfigFile(t, tt.file)}, args...)
+			}
+			_, err := Load(args, env(tt.env))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Load returned %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	if _, err := Load([]string{"-h"}, env(nil)); !errors.Is(err, flag.ErrHelp) {
+		t.Errorf("Load(-h) returned %v, want %v", err, flag.ErrHelp)
+	}
+}
+
+func TestLoadDevTLS(t *testing.T) {
+	cfg, err := Load([]string{"-dev", "-tls", "-redirect-port", "8081"}, env(nil))
+	if err != nil {
+		t.Fatalf("dev mode TLS without a certificate was rejected: %v", err)
+	}
+	if !cfg.TLS || cfg.TLSCert != "" || cfg.RedirectPort != 8081 {
+		t.Errorf("unexpected TLS settings: %+v", cfg)
+	}
+}
+
+func TestLoadDevAssets(t *testing.T) {
+	cfg, err := Load([]string{"-dev"}, env(nil))
+	if err != nil || cfg.AssetsDir != "." {
+		t.Errorf("dev mode serves assets from %q (error %v), want the source tree", cfg.AssetsDir, err)
+	}
+	cfg, err = Load([]string{"-dev", "-assets", "/srv/groupie"}, env(nil))
+	if err != nil || cfg.AssetsDir != "/srv/groupie" {
+		t.Errorf("dev mode serves assets from %q (error %v), want the -assets directory", cfg.AssetsDir, err)
+	}
+}
+
+func TestLoadCORSOrigins(t *testing.T) {
+	file := writeConfigFile(t, `{"cors-origins": ["http://localhost:3000", "https://app.example"]}`)
+	tests := []struct {
+		name string
+		args []string
+		env  map[string]string
+		want []string
+	}{
+		{name: "Default"},
+		{name: "Flag", args: []string{"-cors-origins", "http://localhost:3000, https://app.example,"}, want: []string{"http://localhost:3000", "https://app.example"}},
+		{name: "Env", env: map[string]string{"GROUPIE_CORS_ORIGINS": "*"}, want: []string{"*"}},
+		{name: "File array", args: []string{"-config", file}, want: []string{"http://localhost:3000", "https://app.example"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := Load(tt.args, env(tt.env))
+			if err != nil {
+				t.Fatalf("Load returned %v", err)
+			}
+			if !slices.Equal(cfg.CORSOrigins, tt.want) {
+				t.Errorf("CORSOrigins = %q, want %q", cfg.CORSOrigins, tt.want)
+			}
+		})
+	}
+}
+
+func TestTrustedProxyPrefixes(t *testing.T) {
+	cfg, err := Load([]string{"-trusted-proxies", "10.1.2.3/8, 192.0.2.1, ::1"}, env(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, p := range cfg.TrustedProxyPrefixes() {
+		got = append(got, p.String())
+	}
+	if want := []string{"10.0.0.0/8", "192.0.2.1/32", "::1/128"}; !slices.Equal(got, want) {
+		t.Errorf("TrustedProxyPrefixes() = %q, want %q", got, want)
+	}
+}
+
+func TestValidateReportsEveryProblem(t *testing.T) {
+	cfg := Default()
+	cfg.LogFormat = "xml"
+	cfg.LocationWorkers = 0
+	cfg.ShutdownTimeout = 0
+	err := cfg.Validate()
+	for _, want := range []string{"log-format", "location-workers", "shutdown-timeout"} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Validate returned %v, want it to mention %s", err, want)
+		}
+	}
+}
+
+func TestLogValue(t *testing.T) {
+	cfg, err := Load([]string{"-port", "9003"}, env(map[string]string{"GROUPIE_LOG_FORMAT": "json"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b strings.Builder
+	slog.New(slog.NewTextHandler(&b, nil)).Info("Effective configuration", "config", cfg)
+	for _, want := range []string{`config.port="9003 (flag)"`, `config.log-format="json (env)"`, "config.cache-duration=20m0s"} {
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("printed config is missing %s: %s", want, b.String())
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package groupie
+
+import (
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// ArtistData is the data passed to artist.html.
+type ArtistData struct {
+	Artist CachedArtist
+	Nonce  string
+}
+
+// ArtistHandler serves /artist/{id} as an HTML page, or as JSON to clients
+// that ask for it.
+func ArtistHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		methodNotAllowed(w, r, "GET, HEAD")
+		return
+	}
+
+	params := newQueryParams(r)
+	id, msg := parseArtistID(strings.TrimPrefix(r.URL.Path, "/artist/"))
+	if msg != "" {
+		params.fail("Invalid artist ID", "id", msg)
+	}
+	// Pages ignore the parameters that shape the JSON form
+	var view artistView
+	sparse := false
+	if prefersJSON(r) {
+		view, sparse = params.artistView()
+	}
+	if problem := params.problem(); problem != nil {
+		logInvalidParams(r.Context(), problem)
+		WriteProblem(w, r, problem)
+		return
+	}
+
+	snapshot, err := currentCache(r.Context())
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to load artist data", "error", err)
+		WriteProblem(w, r, problemFor(err))
+		return
+	}
+
+	for _, artist := range snapshot.Artists {
+		if artist.Artist.ID != id {
+			continue
+		}
+		if prefersJSON(r) {
+			if setSnapshotValidators(w, r, snapshot, "json", pageCacheControl) {
+				return
+			}
+			var body any = artist
+			if sparse {
+				body = artistResource(snapshot, artist, view)
+			}
+			if err := writeJSON(w, http.StatusOK, "application/json", body); err != nil {
+				slog.ErrorContext(r.Context(), "Failed to encode artist", logArtistID, id, "error", err)
+			}
+			return
+		}
+		if setSnapshotValidators(w, r, snapshot, "html", htmlCacheControl) {
+			return
+		}
+		page, err := renderPage("artist.html", ArtistData{Artist: artist, Nonce: CSPNonce(r.Context())})
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Failed to render template artist.html", logArtistID, id, "error", err)
+			clearValidators(w.Header())
+			WriteProblem(w, r, NewProblem(http.StatusInternalServerError, "Internal Server Error"))
+			return
+		}
+		if _, err := w.Write(page); err != nil {
+			slog.ErrorContext(r.Context(), "Failed to write artist page", logArtistID, id, "error", err)
+		}
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Artist ID not found", logArtistID, id)
+	WriteProblem(w, r, problemFor(&Error{Kind: ErrNotFound, Detail: "Artist ID not found"}))
+}
@@ -0,0 +1,62 @@
+package groupie
+
+import (
+	"log/slog"
+	"net/http"
+)
+
+// maxBatchIDs is how many artists one /api/v1/artists request may ask for.
+const maxBatchIDs = 50
+
+// ArtistBatch is the body of /api/v1/artists. Artists are in the order their
+// IDs were asked for; NotFound lists the IDs no artist has.
+type ArtistBatch struct {
+	Artists  []map[string]any `json:"artists"`
+	NotFound []int            `json:"notFound"`
+}
+
+// BatchArtistsHandler serves /api/v1/artists?ids=1,2,3&include=locations,
+// returning several artists with the chosen fields and sub-resources in one
+// response.
+func BatchArtistsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		methodNotAllowedJSON(w, r, "GET, HEAD")
+		return
+	}
+	params := newQueryParams(r)
+	ids := params.artistIDs("ids", maxBatchIDs)
+	view, _ := params.artistView()
+	if problem := params.problem(); problem != nil {
+		logInvalidParams(r.Context(), problem)
+		WriteJSONProblem(w, r, problem)
+		return
+	}
+
+	snapshot, err := currentCache(r.Context())
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to load artist data", "error", err)
+		WriteJSONProblem(w, r, problemFor(err))
+		return
+	}
+
+	byID := make(map[int]CachedArtist, len(snapshot.Artists))
+	for _, artist := range snapshot.Artists {
+		byID[artist.Artist.ID] = artist
+	}
+	batch := ArtistBatch{Artists: []map[string]any{}, NotFound: []int{}}
+	for _, id := range ids {
+		artist, ok := byID[id]
+		if !ok {
+			batch.NotFound = append(batch.NotFound, id)
+			continue
+		}
+		batch.Artists = append(batch.Artists, artistResource(snapshot, artist, view))
+	}
+
+	if setSnapshotValidators(w, r, snapshot, "json", apiCacheControl) {
+		return
+	}
+	if err := writeJSON(w, http.StatusOK, "application/json", batch); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to encode artists", "error", err)
+	}
+}
@@ -0,0 +1,393 @@
+package groupie
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// LocationData holds the structure for the location data
+type LocationData struct {
+	Locations []string `json:"locations"`
+}
+
+// CachedArtist includes artist data and cached location data
+type CachedArtist struct {
+	Artist    Artist
+	Locations []string
+}
+
+// Cache structure to store the artist, location, date and relation data and timestamp.
+type DataCache struct {
+	Artists []CachedArtist
+	// Dates and Relations are indexed by artist ID
+	Dates      map[int][]string
+	Relations  map[int]map[string][]string
+	Validation ValidationSummary
+
+	// Version identifies the cached data by content, so it stays the same
+	// across restarts and only changes when the upstream data does.
+	Version string
+	// UpdatedAt is when the data last changed; LastFetched is when it was
+	// last confirmed with the upstream.
+	UpdatedAt   time.Time
+	LastFetched time.Time
+
+	// Upstream responses the data was built from, by index path
+	sources map[string]*cachedResponse
+}
+
+// CacheDuration is how long the cached data is served before a request
+// refreshes it (20 minutes unless configured).
+var CacheDuration = 20 * time.Minute
+
+// SetCacheDuration changes how long the cached data is served.
+func SetCacheDuration(d time.Duration) {
+	CacheDuration = d
+}
+
+// refreshTimeout bounds a refresh a request waits for, so that a slow
+// upstream is still answered with an error before the server's write timeout
+// cuts the connection. Zero waits as long as the refresh takes.
+var refreshTimeout time.Duration
+
+// SetRefreshTimeout changes how long a request waits for an expired cache to
+// be refreshed.
+func SetRefreshTimeout(d time.Duration) {
+	refreshTimeout = d
+}
+
+// Cache variable to hold the artist, location, date and relation data.
+// Handlers take a copy with currentCache; cacheMu guards replacing it.
+var (
+	cacheMu   sync.RWMutex
+	dataCache = DataCache{}
+)
+
+// PreloadDataCache fetches artist and location data on server startup
+func PreloadDataCache(ctx context.Context) ([]CachedArtist, error) {
+	return FetchArtistDataWithLocations(ctx)
+}
+
+// RefreshCache loads the cache now and then every interval, so requests
+// rarely wait on the upstream, until ctx is done. With a zero interval it
+// loads the cache once.
+func RefreshCache(ctx context.Context, interval time.Duration) {
+	if _, err := PreloadDataCache(ctx); err != nil && ctx.Err() == nil {
+		slog.ErrorContext(ctx, "Failed to preload cache", "error", err)
+	}
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			slog.InfoContext(ctx, "Cache refresher stopped")
+			return
+		case <-ticker.C:
+			if _, err := FetchArtistDataWithLocations(ctx); err != nil && ctx.Err() == nil {
+				slog.ErrorContext(ctx, "Failed to refresh cache", "error", err)
+			}
+		}
+	}
+}
+
+// FetchLocations fetches location data for a given URL.
+func FetchLocations(ctx context.Context, url string) ([]string, error) {
+	var locationData LocationData
+	if err := fetchJSON(ctx, url, &locationData); err != nil {
+		return nil, fmt.Errorf("failed to fetch location data: %w", err)
+	}
+
+	return locationData.Locations, nil
+}
+
+// LocationFetchOptions controls how the cache loads artist locations.
+type LocationFetchOptions struct {
+	// BulkIndex loads every artist's locations with a single request to the
+	// /locations index instead of one request per artist.
+	BulkIndex bool
+	// Workers bounds the number of concurrent per-artist requests.
+	Workers int
+}
+
+// Location loading settings used by FetchArtistDataWithLocations.
+var locationFetch = LocationFetchOptions{BulkIndex: true, Workers: 8}
+
+// SetLocationFetchOptions changes how the cache loads artist locations.
+func SetLocationFetchOptions(o LocationFetchOptions) {
+	if o.Workers < 1 {
+		o.Workers = 1
+	}
+	locationFetch = o
+}
+
+// upstreamIndex is one resource loaded by the cache refresh.
+type upstreamIndex struct {
+	path     string
+	v        any
+	resp     *cachedResponse
+	modified bool
+}
+
+// FetchArtistDataWithLocations fetches artist data along with location, date and
+// relation data, validates it and updates the cache. The indexes are fetched
+// with conditional requests: when none of them changed upstream since the
+// cached data was built, it is kept as it is and only its timestamp is renewed.
+func FetchArtistDataWithLocations(ctx context.Context) ([]CachedArtist, error) {
+	start := time.Now()
+	result := "error"
+	defer func() { metrics.cacheRefreshes.inc(result) }()
+	var artists []Artist
+	var locations Locations
+	var dates Dates
+	var relations Relations
+	indexes := []*upstreamIndex{
+		{path: "/artists", v: &artists},
+		{path: "/dates", v: &dates},
+		{path: "/relation", v: &relations},
+	}
+	if locationFetch.BulkIndex {
+		indexes = append(indexes, &upstreamIndex{path: "/locations", v: &locations})
+	}
+
+	cacheMu.RLock()
+	sources := dataCache.sources
+	cacheMu.RUnlock()
+
+	// Per-artist locations are not covered by the indexes, so that mode always
+	// rebuilds. A 304 only means the response matches the stored one, which a
+	// failed refresh may have stored without the cache being built from it.
+	changed := !locationFetch.BulkIndex
+	for _, index := range indexes {
+		url := upstream.URL(index.path)
+		resp, err := upstream.getJSON(ctx, url, index.v)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch %s: %w", index.path, err)
+		}
+		index.modified = resp != nil
+		if resp == nil {
+			if resp = upstream.cachedResponse(url); resp == nil {
+				return nil, fmt.Errorf("failed to reuse %s: no cached response", index.path)
+			}
+		}
+		index.resp = resp
+		changed = changed || index.modified || sources[index.path] != resp
+	}
+
+	if !changed {
+		if artists, ok := touchCache(); ok {
+			result = "not_modified"
+			slog.InfoContext(ctx, "Upstream data not modified, keeping cached data", logDuration, time.Since(start))
+			return artists, nil
+		}
+		// The cache is empty, so rebuild it from the stored responses
+	}
+	for _, index := range indexes {
+		if index.modified {
+			continue
+		}
+		if err := json.Unmarshal(index.resp.body, index.v); err != nil {
+			return nil, fmt.Errorf("failed to reuse %s: %w", index.path, err)
+		}
+	}
+
+	var summary ValidationSummary
+	artists = validateArtists(artists, &summary)
+	if len(artists) == 0 {
+		summary.log(ctx)
+		return nil, &Error{Kind: ErrUpstreamMalformed, Err: errors.New("no valid artists in upstream data")}
+	}
+
+	// IDs present in each index, for the cross-check
+	ids := make(map[string]map[int]bool)
+
+	var cachedArtists []CachedArtist
+	if locationFetch.BulkIndex {
+		cachedArtists, ids[ResourceLocations] = attachLocations(artists, locations.Index, &summary)
+	} else {
+		var err error
+		cachedArtists, err = fetchLocationsPerArtist(ctx, artists, locationFetch.Workers)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	datesByID := make(map[int][]string, len(dates.Index))
+	ids[ResourceDates] = make(map[int]bool, len(dates.Index))
+	for _, entry := range validateDates(dates.Index, &summary) {
+		datesByID[entry.ID] = entry.Dates
+		ids[ResourceDates][entry.ID] = true
+	}
+
+	relationsByID := make(map[int]map[string][]string, len(relations.Index))
+	ids[ResourceRelations] = make(map[int]bool, len(relations.Index))
+	for _, entry := range validateRelations(relations.Index, &summary) {
+		relationsByID[entry.ID] = entry.DatesLocations
+		ids[ResourceRelations][entry.ID] = true
+	}
+
+	crossCheck(artists, ids, &summary)
+	summary.log(ctx)
+
+	version, err := snapshotVersion(cachedArtists, datesByID, relationsByID)
+	if err != nil {
+		return nil, err
+	}
+
+	sources = make(map[string]*cachedResponse, len(indexes))
+	for _, index := range indexes {
+		sources[index.path] = index.resp
+	}
+
+	// Update cache
+	now := time.Now()
+	cacheMu.Lock()
+	dataCache = DataCache{
+		Artists:     cachedArtists,
+		Dates:       datesByID,
+		Relations:   relationsByID,
+		Validation:  summary,
+		Version:     version,
+		UpdatedAt:   now,
+		LastFetched: now,
+		sources:     sources,
+	}
+	cacheMu.Unlock()
+	result = "updated"
+	slog.InfoContext(ctx, "Cache refreshed", "version", version, "artists", len(cachedArtists), logDuration, time.Since(start))
+
+	return cachedArtists, nil
+}
+
+// touchCache renews the timestamp of the cached data, if there is any.
+func touchCache() ([]CachedArtist, bool) {
+	cacheMu.Lock()
+	defer cacheMu.Unlock()
+	if dataCache.LastFetched.IsZero() {
+		return nil, false
+	}
+	dataCache.LastFetched = time.Now()
+	return dataCache.Artists, true
+}
+
+// snapshotVersion hashes the data served to clients.
+func snapshotVersion(artists []CachedArtist, dates map[int][]string, relations map[int]map[string][]string) (string, error) {
+	data, err := json.Marshal(struct {
+		Artists   []CachedArtist
+		Dates     map[int][]string
+		Relations map[int]map[string][]string
+	}{artists, dates, relations})
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:8]), nil
+}
+
+// attachLocations attaches locations to artists from the /locations index. It
+// also returns the IDs found in the index.
+func attachLocations(artists []Artist, index []LocationEntry, s *ValidationSummary) ([]CachedArtist, map[int]bool) {
+	byID := make(map[int][]string, len(index))
+	ids := make(map[int]bool, len(index))
+	for _, loc := range validateLocations(index, s) {
+		byID[loc.ID] = loc.Locations
+		ids[loc.ID] = true
+	}
+
+	cachedArtists := make([]CachedArtist, len(artists))
+	for i, artist := range artists {
+		locations, ok := byID[artist.ID]
+		if !ok {
+			locations = []string{}
+		}
+		cachedArtists[i] = CachedArtist{Artist: artist, Locations: locations}
+	}
+	return cachedArtists, ids
+}
+
+// fetchLocationsPerArtist fetches each artist's locations URL using a pool of
+// workers, keeping the artists in their original order. It stops handing out
+// work once ctx is done.
+func fetchLocationsPerArtist(ctx context.Context, artists []Artist, workers int) ([]CachedArtist, error) {
+	cachedArtists := make([]CachedArtist, len(artists))
+	jobs := make(chan int)
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				artist := artists[i]
+				locations, err := FetchLocations(ctx, artist.Locations)
+				if err != nil {
+					slog.WarnContext(ctx, "Failed to fetch artist locations", logArtistID, artist.ID, logUpstreamURL, artist.Locations, "error", err)
+					locations = []string{}
+				}
+				cachedArtists[i] = CachedArtist{Artist: artist, Locations: locations}
+			}
+		}()
+	}
+
+dispatch:
+	for i := range artists {
+		select {
+		case jobs <- i:
+		case <-ctx.Done():
+			break dispatch
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return cachedArtists, nil
+}
+
+// currentCache returns a copy of the cache, refreshing it first if it has
+// expired. The copy stays consistent while a later refresh replaces the cache.
+func currentCache(ctx context.Context) (DataCache, error) {
+	cacheMu.RLock()
+	snapshot := dataCache
+	cacheMu.RUnlock()
+
+	if time.Since(snapshot.LastFetched) <= CacheDuration {
+		metrics.cacheLookups.inc("hit")
+	} else {
+		metrics.cacheLookups.inc("miss")
+		if refreshTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, refreshTimeout)
+			defer cancel()
+		}
+		if _, err := FetchArtistDataWithLocations(ctx); err != nil {
+			return DataCache{}, err
+		}
+		cacheMu.RLock()
+		snapshot = dataCache
+		cacheMu.RUnlock()
+	}
+	return snapshot, nil
+}
+
+// findArtist returns the cached artist with the given ID.
+func (c DataCache) findArtist(id int) (CachedArtist, bool) {
+	for _, artist := range c.Artists {
+		if artist.Artist.ID == id {
+			return artist, true
+		}
+	}
+	return CachedArtist{}, false
+}
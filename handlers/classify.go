@@ -0,0 +1,96 @@
+package groupie
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+// StatusClientClosedRequest is reported when the client went away before the
+// response was ready. Nobody reads it, but it keeps access logs accurate.
+const StatusClientClosedRequest = 499
+
+// Error kinds the handlers distinguish when reporting a failure. Errors are
+// matched against them with errors.Is.
+var (
+	ErrValidation          = errors.New("invalid request")
+	ErrNotFound            = errors.New("not found")
+	ErrUpstreamUnavailable = errors.New("upstream unavailable")
+	ErrUpstreamTimeout     = errors.New("upstream timeout")
+	ErrUpstreamMalformed   = errors.New("upstream returned malformed data")
+)
+
+// Error is a classified failure. Kind is one of the error kinds above and
+// Detail is a message that is safe to show to clients.
+type Error struct {
+	Kind   error
+	Detail string
+	Err    error
+}
+
+func (e *Error) Error() string {
+	msg := e.Kind.Error()
+	if e.Detail != "" {
+		msg += ": " + e.Detail
+	}
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+func (e *Error) Unwrap() []error {
+	if e.Err == nil {
+		return []error{e.Kind}
+	}
+	return []error{e.Kind, e.Err}
+}
+
+// StatusCode maps an error to the HTTP status code reported to the client.
+// Unclassified errors are internal server errors.
+func StatusCode(err error) int {
+	switch {
+	case errors.Is(err, context.Canceled):
+		return StatusClientClosedRequest
+	case errors.Is(err, ErrValidation):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrUpstreamTimeout):
+		return http.StatusGatewayTimeout
+	case errors.Is(err, ErrUpstreamUnavailable), errors.Is(err, ErrUpstreamMalformed):
+		return http.StatusBadGateway
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// problemFor builds the problem document describing err. Only details set on
+// an *Error reach the client; anything else gets a generic message so upstream
+// URLs and internal errors are not leaked.
+func problemFor(err error) *Problem {
+	status := StatusCode(err)
+	detail := http.StatusText(status)
+	switch {
+	case errors.Is(err, ErrUpstreamTimeout):
+		detail = "The artist data service did not respond in time"
+	case errors.Is(err, ErrUpstreamMalformed):
+		detail = "The artist data service returned invalid data"
+	case errors.Is(err, ErrUpstreamUnavailable):
+		detail = "The artist data service is unavailable"
+	}
+	var e *Error
+	if errors.As(err, &e) && e.Detail != "" {
+		detail = e.Detail
+	}
+
+	p := NewProblem(status, detail)
+	switch status {
+	case http.StatusBadRequest:
+		p.Type = ProblemTypeValidation
+	case StatusClientClosedRequest:
+		p.Title = "Client Closed Request"
+		p.Detail = "The request was canceled"
+	}
+	return p
+}
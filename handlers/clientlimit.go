@@ -0,0 +1,176 @@
+package groupie
+
+import (
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimit allows Rate requests per second with bursts of up to Burst. A
+// zero Rate disables it.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// RateLimitOptions are the per-client request limits.
+type RateLimitOptions struct {
+	// Search limits /search and /getArtists, which are called as the user
+	// types and may trigger an upstream refetch.
+	Search RateLimit
+	// API limits every other route that is not exempt.
+	API RateLimit
+	// TrustedProxies are the addresses whose X-Forwarded-For header is
+	// believed. Without them the client is the connection's peer.
+	TrustedProxies []netip.Prefix
+}
+
+// rateLimitExempt are routes that are never limited: probes and scrapes must
+// keep working while a client is being throttled.
+var rateLimitExempt = map[string]bool{
+	"/healthz": true, "/readyz": true, "/metrics": true,
+}
+
+// rateLimitClass returns the limit that applies to path, or "" if none does.
+func rateLimitClass(path string) string {
+	switch route := routeLabel(path); {
+	case rateLimitExempt[route]:
+		return ""
+	case route == "/search" || route == "/getArtists":
+		return "search"
+	default:
+		return "api"
+	}
+}
+
+// RateLimiter answers 429 Too Many Requests, with a Retry-After header, to
+// clients that go over their limit for a route.
+func RateLimiter(opts RateLimitOptions) Middleware {
+	limiters := map[string]*clientLimiter{}
+	if opts.Search.Rate > 0 {
+		limiters["search"] = newClientLimiter(opts.Search)
+	}
+	if opts.API.Rate > 0 {
+		limiters["api"] = newClientLimiter(opts.API)
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			l := limiters[rateLimitClass(r.URL.Path)]
+			if l == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+			client := clientIP(r, opts.TrustedProxies)
+			ok, wait := l.allow(clientKey(client), time.Now())
+			if ok {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			retryAfter := strconv.Itoa(int(math.Ceil(wait.Seconds())))
+			slog.InfoContext(r.Context(), "Rate limit exceeded", "client", client, "path", r.URL.Path, "retry_after", retryAfter)
+			w.Header().Set("Retry-After", retryAfter)
+			w.Header().Set("Cache-Control", "no-store")
+			problem := NewProblem(http.StatusTooManyRequests, "Too many requests, please retry in "+retryAfter+"s")
+			// Only the pages answer in HTML; API callers always get JSON
+			if route := routeLabel(r.URL.Path); route == "/" || route == "/artist/{id}" {
+				WriteProblem(w, r, problem)
+			} else {
+				WriteJSONProblem(w, r, problem)
+			}
+		})
+	}
+}
+
+// clientLimiter keeps one token bucket per client, dropping those that have
+// refilled so idle clients do not pile up.
+type clientLimiter struct {
+	limit RateLimit
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+// clientSweepInterval is how often clientLimiter looks for idle buckets.
+const clientSweepInterval = time.Minute
+
+func newClientLimiter(limit RateLimit) *clientLimiter {
+	return &clientLimiter{limit: limit, buckets: make(map[string]*tokenBucket)}
+}
+
+func (l *clientLimiter) allow(client string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	if now.Sub(l.lastSweep) >= clientSweepInterval {
+		for key, b := range l.buckets {
+			if b.full(now) {
+				delete(l.buckets, key)
+			}
+		}
+		l.lastSweep = now
+	}
+	b, ok := l.buckets[client]
+	if !ok {
+		b = newTokenBucket(l.limit.Rate, l.limit.Burst)
+		l.buckets[client] = b
+	}
+	l.mu.Unlock()
+	return b.allow(now)
+}
+
+// clientIP returns the address of the client that sent r. When the peer is a
+// trusted proxy, X-Forwarded-For is read from the right and the first
+// address that is not a trusted proxy is the client.
+func clientIP(r *http.Request, trusted []netip.Prefix) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	peer, err := netip.ParseAddr(host)
+	if err != nil || !isTrusted(peer, trusted) {
+		return host
+	}
+
+	client := peer
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		addr, err := netip.ParseAddr(strings.TrimSpace(forwarded[i]))
+		if err != nil {
+			// Anything left of a malformed entry cannot be trusted either
+			break
+		}
+		client = addr
+		if !isTrusted(addr, trusted) {
+			break
+		}
+	}
+	return client.Unmap().String()
+}
+
+// clientKey groups IPv6 clients by /64, the block a single host usually
+// controls, so that rotating addresses does not reset the limit.
+func clientKey(client string) string {
+	addr, err := netip.ParseAddr(client)
+	if err != nil || !addr.Is6() {
+		return client
+	}
+	p, _ := addr.Prefix(64)
+	return p.String()
+}
+
+func isTrusted(addr netip.Addr, trusted []netip.Prefix) bool {
+	addr = addr.Unmap()
+	for _, p := range trusted {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,183 @@
+package groupie
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// compressMinSize is the smallest body, when its length is known up front,
+// that is worth compressing.
+const compressMinSize = 512
+
+// compressibleTypes are the media types sent gzipped besides text/*. Images,
+// audio and archives are already compressed and are sent as they are.
+var compressibleTypes = map[string]bool{
+	"application/json":         true,
+	"application/problem+json": true,
+	"application/javascript":   true,
+	"application/xml":          true,
+	"image/svg+xml":            true,
+}
+
+var gzipWriters = sync.Pool{
+	New: func() any { return gzip.NewWriter(io.Discard) },
+}
+
+// Compress gzips the responses of next for clients that accept it. zstd is
+// not offered: the standard library has no encoder for it.
+func Compress(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if codingQuality(r.Header.Get("Accept-Encoding"), "gzip") <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// The client holds the gzip variant's ETag; the handlers know the plain one
+		if inm := r.Header.Get("If-None-Match"); inm != "" {
+			r.Header.Set("If-None-Match", stripGzipETags(inm))
+		}
+		cw := &compressWriter{ResponseWriter: w}
+		defer cw.close()
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// codingQuality returns the q value the Accept-Encoding header gives to
+// coding. An explicit entry wins over "*".
+func codingQuality(acceptEncoding, coding string) float64 {
+	best, exact := 0.0, false
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		fields := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(fields[0]))
+		if name != coding && (name != "*" || exact) {
+			continue
+		}
+
+		q := 1.0
+		for _, param := range fields[1:] {
+			key, value, ok := strings.Cut(strings.TrimSpace(param), "=")
+			if ok && strings.EqualFold(key, "q") {
+				if v, err := strconv.ParseFloat(value, 64); err == nil {
+					q = v
+				}
+			}
+		}
+		best, exact = q, name == coding
+	}
+	return best
+}
+
+// compressWriter gzips the body once the headers show it is worth it.
+type compressWriter struct {
+	http.ResponseWriter
+	gz          *gzip.Writer
+	wroteHeader bool
+}
+
+func (cw *compressWriter) WriteHeader(code int) {
+	if cw.wroteHeader {
+		cw.ResponseWriter.WriteHeader(code)
+		return
+	}
+	cw.wroteHeader = true
+
+	h := cw.Header()
+	compress := shouldCompress(code, h)
+	if etag := h.Get("ETag"); etag != "" && (compress || code == http.StatusNotModified) {
+		h.Set("ETag", gzipETag(etag))
+	}
+	if compress {
+		// Byte ranges of the identity body do not apply to the gzipped one
+		h.Del("Content-Length")
+		h.Del("Accept-Ranges")
+		h.Set("Content-Encoding", "gzip")
+		cw.gz = gzipWriters.Get().(*gzip.Writer)
+		cw.gz.Reset(cw.ResponseWriter)
+	}
+	cw.ResponseWriter.WriteHeader(code)
+}
+
+func (cw *compressWriter) Write(p []byte) (int, error) {
+	if !cw.wroteHeader {
+		// Sniff the type as net/http would, since it decides the encoding
+		if cw.Header().Get("Content-Type") == "" {
+			cw.Header().Set("Content-Type", http.DetectContentType(p))
+		}
+		cw.WriteHeader(http.StatusOK)
+	}
+	if cw.gz != nil {
+		return cw.gz.Write(p)
+	}
+	return cw.ResponseWriter.Write(p)
+}
+
+// Flush sends what has been compressed so far.
+func (cw *compressWriter) Flush() {
+	if cw.gz != nil {
+		cw.gz.Flush()
+	}
+	http.NewResponseController(cw.ResponseWriter).Flush()
+}
+
+// Unwrap gives http.ResponseController access to the underlying writer.
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// close finishes the gzip stream and returns the writer to the pool.
+func (cw *compressWriter) close() {
+	if cw.gz == nil {
+		return
+	}
+	cw.gz.Close()
+	cw.gz.Reset(io.Discard)
+	gzipWriters.Put(cw.gz)
+	cw.gz = nil
+}
+
+// shouldCompress reports whether a response with this status and these
+// headers gets gzipped.
+func shouldCompress(code int, h http.Header) bool {
+	switch {
+	case code < http.StatusOK, code == http.StatusNoContent, code == http.StatusPartialContent, code == http.StatusNotModified:
+		return false
+	case h.Get("Content-Encoding") != "", h.Get("Content-Range") != "":
+		return false
+	}
+	if cl := h.Get("Content-Length"); cl != "" {
+		if n, err := strconv.Atoi(cl); err == nil && n < compressMinSize {
+			return false
+		}
+	}
+	mediaType, _, _ := strings.Cut(h.Get("Content-Type"), ";")
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+	return strings.HasPrefix(mediaType, "text/") || compressibleTypes[mediaType]
+}
+
+// gzipETag marks an ETag as belonging to the gzipped representation. A weak
+// ETag stays weak.
+func gzipETag(etag string) string {
+	opaque, weak := strings.CutPrefix(etag, "W/")
+	if !strings.HasPrefix(opaque, `"`) || strings.HasSuffix(opaque, `-gzip"`) {
+		return etag
+	}
+	opaque = strings.TrimSuffix(opaque, `"`) + `-gzip"`
+	if weak {
+		return "W/" + opaque
+	}
+	return opaque
+}
+
+// stripGzipETags undoes gzipETag on each entry of an If-None-Match header.
+func stripGzipETags(ifNoneMatch string) string {
+	candidates := strings.Split(ifNoneMatch, ",")
+	for i, candidate := range candidates {
+		candidates[i] = strings.Replace(strings.TrimSpace(candidate), `-gzip"`, `"`, 1)
+	}
+	return strings.Join(candidates, ", ")
+}
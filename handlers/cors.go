@@ -0,0 +1,106 @@
+package groupie
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Methods and request headers cross-origin callers may use. The API is read
+// only, so anything else is refused at preflight.
+const (
+	corsAllowedMethods = "GET, HEAD"
+	corsExposedHeaders = "ETag, Last-Modified, Retry-After, X-Request-ID"
+)
+
+var corsAllowedHeaders = map[string]bool{
+	"accept":            true,
+	"accept-language":   true,
+	"content-type":      true,
+	"if-modified-since": true,
+	"if-none-match":     true,
+	"x-request-id":      true,
+}
+
+// CORSOptions is the cross-origin policy of the API.
+type CORSOptions struct {
+	// AllowedOrigins lists origins such as "http://localhost:3000" that may
+	// call the API from a browser. "*" allows every origin.
+	AllowedOrigins []string
+	// MaxAge is how long browsers may cache a preflight response.
+	MaxAge time.Duration
+}
+
+// CORS answers preflight requests and adds the CORS response headers for the
+// allowed origins. Requests from other origins are served without them, so
+// the browser keeps the response from the calling page.
+func CORS(opts CORSOptions) Middleware {
+	allowAll := false
+	allowed := make(map[string]bool, len(opts.AllowedOrigins))
+	for _, origin := range opts.AllowedOrigins {
+		if origin == "*" {
+			allowAll = true
+		}
+		allowed[strings.ToLower(strings.TrimSuffix(origin, "/"))] = true
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			h := w.Header()
+			origin := r.Header.Get("Origin")
+			preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+			h.Add("Vary", "Origin")
+			if preflight {
+				h.Add("Vary", "Access-Control-Request-Method")
+				h.Add("Vary", "Access-Control-Request-Headers")
+			}
+
+			ok := origin != "" && (allowAll || allowed[strings.ToLower(origin)])
+			if ok {
+				if allowAll {
+					h.Set("Access-Control-Allow-Origin", "*")
+				} else {
+					h.Set("Access-Control-Allow-Origin", origin)
+				}
+			}
+			if !preflight {
+				if ok {
+					h.Set("Access-Control-Expose-Headers", corsExposedHeaders)
+				}
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			// A refused preflight gets no CORS headers, which the browser reports
+			if ok && corsMethodAllowed(r.Header.Get("Access-Control-Request-Method")) && corsHeadersAllowed(r.Header.Get("Access-Control-Request-Headers")) {
+				h.Set("Access-Control-Allow-Methods", corsAllowedMethods)
+				if requested := r.Header.Get("Access-Control-Request-Headers"); requested != "" {
+					h.Set("Access-Control-Allow-Headers", requested)
+				}
+				if opts.MaxAge > 0 {
+					h.Set("Access-Control-Max-Age", strconv.Itoa(int(opts.MaxAge.Seconds())))
+				}
+			} else {
+				h.Del("Access-Control-Allow-Origin")
+			}
+			w.WriteHeader(http.StatusNoContent)
+		})
+	}
+}
+
+func corsMethodAllowed(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead
+}
+
+// corsHeadersAllowed reports whether every header in an
+// Access-Control-Request-Headers list may be sent.
+func corsHeadersAllowed(requested string) bool {
+	for _, name := range strings.Split(requested, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name != "" && !corsAllowedHeaders[name] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,84 @@
+package groupie
+
+import "slices"
+
+// Attributes of an artist that fields= can select. The ID is always sent.
+var artistFields = []string{"id", "name", "image", "members", "creationDate", "firstAlbum"}
+
+// Sub-resources include= can embed in an artist.
+const (
+	includeLocations = "locations"
+	includeDates     = "dates"
+	includeRelations = "relations"
+)
+
+var artistIncludes = []string{includeLocations, includeDates, includeRelations}
+
+// artistView is the part of each artist a client asked to see.
+type artistView struct {
+	// fields are the attributes to send, every one if nil
+	fields  []string
+	include []string
+}
+
+// artistView reads fields= and include=. requested reports whether either
+// was given, for the endpoints that otherwise keep their original response.
+func (p *queryParams) artistView() (view artistView, requested bool) {
+	view.fields = p.list("fields", len(artistFields), artistFields...)
+	view.include = p.list("include", len(artistIncludes), artistIncludes...)
+	return view, p.values.Has("fields") || p.values.Has("include")
+}
+
+// artistResource returns the API form of artist: the attributes in view,
+// without the upstream's links, plus the included sub-resources. Included
+// ones are always present, empty when the upstream has no data for the
+// artist.
+func artistResource(snapshot DataCache, artist CachedArtist, view artistView) map[string]any {
+	a := artist.Artist
+	attributes := map[string]any{
+		"name":         a.Name,
+		"image":        a.Image,
+		"members":      nonNil(a.Members),
+		"creationDate": a.CreationDate,
+		"firstAlbum":   a.FirstAlbum,
+	}
+	resource := map[string]any{"id": a.ID}
+	for name, value := range attributes {
+		if view.fields == nil || slices.Contains(view.fields, name) {
+			resource[name] = value
+		}
+	}
+
+	for _, name := range view.include {
+		switch name {
+		case includeLocations:
+			resource[name] = nonNil(artist.Locations)
+		case includeDates:
+			resource[name] = nonNil(snapshot.Dates[a.ID])
+		case includeRelations:
+			relations := snapshot.Relations[a.ID]
+			if relations == nil {
+				relations = map[string][]string{}
+			}
+			resource[name] = relations
+		}
+	}
+	return resource
+}
+
+// artistResources returns the API form of every artist.
+func artistResources(snapshot DataCache, artists []CachedArtist, view artistView) []map[string]any {
+	resources := make([]map[string]any, len(artists))
+	for i, artist := range artists {
+		resources[i] = artistResource(snapshot, artist, view)
+	}
+	return resources
+}
+
+// nonNil makes an empty list encode as [] rather than null.
+func nonNil(s []string) []string {
+	if s == nil {
+		return []string{}
+	}
+	return s
+}
@@ -1,31 +1,38 @@
 package groupie
+
 import (
 	"encoding/json"
-	"log"
+	"log/slog"
 	"net/http"
 	"strconv"
 	"strings"
-	"time"
 )
+
 // FilteredArtistsHandler fetches and returns all artist data matching the search query.
 func FilteredArtistsHandler(w http.ResponseWriter, r *http.Request) {
-	query := r.URL.Query().Get("q")
-	if query == "" {
-		http.Error(w, "Search query is required", http.StatusBadRequest)
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		methodNotAllowedJSON(w, r, "GET, HEAD")
+		return
+	}
+	params := newQueryParams(r)
+	query := params.searchQuery("q")
+	view, sparse := params.artistView()
+	if problem := params.problem(); problem != nil {
+		logInvalidParams(r.Context(), problem)
+		WriteJSONProblem(w, r, problem)
 		return
 	}
 	// Refresh cache if expired
-	if time.Since(dataCache.LastFetched) > CacheDuration {
-		if _, err := FetchArtistDataWithLocations(); err != nil {
-			log.Printf("Failed to refresh artist data with locations: %s", err)
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-			return
-		}
+	snapshot, err := currentCache(r.Context())
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to load artist data", "error", err)
+		WriteJSONProblem(w, r, problemFor(err))
+		return
 	}
 	query = strings.ToLower(query)
 	var filteredArtists []CachedArtist
 	// Filter through cached artist data based on the search query
-	for _, cachedArtist := range dataCache.Artists {
+	for _, cachedArtist := range snapshot.Artists {
 		artist := cachedArtist.Artist
 		matchFound := false
 		// Check artist name
@@ -60,9 +67,16 @@ func FilteredArtistsHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 	// Convert filtered artists to JSON and return
+	if setSnapshotValidators(w, r, snapshot, "json", apiCacheControl) {
+		return
+	}
+	var body any = filteredArtists
+	if sparse {
+		body = artistResources(snapshot, filteredArtists, view)
+	}
 	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(filteredArtists); err != nil {
-		log.Printf("Failed to encode filtered artists: %s", err)
-		http.Error(w, "Failed to return filtered artists", http.StatusInternalServerError)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to encode filtered artists", "error", err)
+		WriteJSONProblem(w, r, NewProblem(http.StatusInternalServerError, "Failed to return filtered artists"))
 	}
 }
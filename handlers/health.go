@@ -0,0 +1,109 @@
+package groupie
+
+import (
+	"net/http"
+	"time"
+)
+
+// Check outcomes reported by /readyz.
+const (
+	checkOK   = "ok"
+	checkFail = "fail"
+)
+
+// readyMaxCacheAge is how old the cached data may get before the instance
+// stops reporting ready. It leaves room for refreshes that fail for a while.
+var readyMaxCacheAge = 3 * CacheDuration
+
+// SetReadyMaxCacheAge sets the cache age above which /readyz fails.
+func SetReadyMaxCacheAge(d time.Duration) {
+	readyMaxCacheAge = d
+}
+
+// Readiness is the body of /readyz.
+type Readiness struct {
+	Status   string        `json:"status"`
+	Cache    CacheCheck    `json:"cache"`
+	Upstream UpstreamCheck `json:"upstream"`
+}
+
+// CacheCheck reports whether the cached data can be served.
+type CacheCheck struct {
+	Status        string  `json:"status"`
+	Loaded        bool    `json:"loaded"`
+	Artists       int     `json:"artists"`
+	Version       string  `json:"version,omitempty"`
+	AgeSeconds    float64 `json:"ageSeconds,omitempty"`
+	MaxAgeSeconds float64 `json:"maxAgeSeconds"`
+	Detail        string  `json:"detail,omitempty"`
+}
+
+// UpstreamCheck reports the state of the upstream circuit breaker.
+type UpstreamCheck struct {
+	Status  string `json:"status"`
+	Circuit string `json:"circuit"`
+	Detail  string `json:"detail,omitempty"`
+}
+
+// HealthHandler serves /healthz: the process is up and serving HTTP.
+func HealthHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		methodNotAllowedJSON(w, r, "GET, HEAD")
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, "application/json", map[string]string{"status": checkOK})
+}
+
+// ReadyHandler serves /readyz: 200 when the instance has artist data it can
+// serve, 503 with the failing checks otherwise.
+func ReadyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		methodNotAllowedJSON(w, r, "GET, HEAD")
+		return
+	}
+	report := readiness(time.Now())
+	code := http.StatusOK
+	if report.Status != "ready" {
+		code = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, code, "application/json", report)
+}
+
+// readiness checks the cached data and the upstream circuit as of now.
+func readiness(now time.Time) Readiness {
+	cacheMu.RLock()
+	snapshot := dataCache
+	cacheMu.RUnlock()
+
+	cache := CacheCheck{
+		Status:        checkOK,
+		Loaded:        !snapshot.LastFetched.IsZero() && len(snapshot.Artists) > 0,
+		Artists:       len(snapshot.Artists),
+		Version:       snapshot.Version,
+		MaxAgeSeconds: readyMaxCacheAge.Seconds(),
+	}
+	age := now.Sub(snapshot.LastFetched)
+	switch {
+	case !cache.Loaded:
+		cache.Status, cache.Detail = checkFail, "artist data has not been loaded"
+	case age > readyMaxCacheAge:
+		cache.AgeSeconds = age.Seconds()
+		cache.Status, cache.Detail = checkFail, "artist data is older than the maximum age"
+	default:
+		cache.AgeSeconds = age.Seconds()
+	}
+
+	check := UpstreamCheck{Status: checkOK, Circuit: upstream.Breaker.State()}
+	// An open circuit only matters once the cache needs a refresh it would reject
+	if check.Circuit == CircuitOpen && (!cache.Loaded || age > CacheDuration) {
+		check.Status, check.Detail = checkFail, "upstream circuit is open and the cached data has expired"
+	}
+
+	report := Readiness{Status: "ready", Cache: cache, Upstream: check}
+	if cache.Status != checkOK || check.Status != checkOK {
+		report.Status = "not ready"
+	}
+	return report
+}
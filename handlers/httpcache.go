@@ -0,0 +1,143 @@
+package groupie
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Cache-Control policies for our responses. Pages are always revalidated,
+// and their HTML, which carries the nonce of one response, is not shared;
+// artist data may be reused briefly, which keeps modals instant. Static file
+// URLs are not versioned, so those are revalidated against their ETag too.
+const (
+	pageCacheControl   = "no-cache"
+	htmlCacheControl   = "private, no-cache"
+	apiCacheControl    = "public, max-age=60"
+	staticCacheControl = "no-cache"
+)
+
+// setSnapshotValidators sets the ETag, Last-Modified and Cache-Control of a
+// response built from snapshot. representation tells apart the HTML and JSON
+// forms of the same URL; the HTML one gets a weak ETag, since its nonce makes
+// every response differ byte for byte. It reports whether the client's copy is still
+// current, in which case a 304 Not Modified has been written.
+func setSnapshotValidators(w http.ResponseWriter, r *http.Request, snapshot DataCache, representation, cacheControl string) bool {
+	h := w.Header()
+	h.Set("Cache-Control", cacheControl)
+	h.Add("Vary", "Accept")
+	if snapshot.Version == "" {
+		return false
+	}
+
+	etag := fmt.Sprintf(`"%s-%s"`, snapshot.Version, representation)
+	if representation == "html" {
+		etag = "W/" + etag
+	}
+	h.Set("ETag", etag)
+	if !snapshot.UpdatedAt.IsZero() {
+		h.Set("Last-Modified", snapshot.UpdatedAt.UTC().Format(http.TimeFormat))
+	}
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	// If-Modified-Since only counts when the client sent no ETag
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		if !etagMatches(inm, etag) {
+			return false
+		}
+	} else if ims, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err != nil || snapshot.UpdatedAt.Truncate(time.Second).After(ims) {
+		return false
+	}
+
+	// A 304 carries the validators but no body headers. Nor does it carry the
+	// policy: browsers would store its nonce with a page holding the old one.
+	h.Del("Content-Type")
+	h.Del("Content-Security-Policy")
+	h.Del("Content-Security-Policy-Report-Only")
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// clearValidators removes the validators and caching policy set for a
+// response that is being replaced by an error.
+func clearValidators(h http.Header) {
+	for _, name := range []string{"ETag", "Last-Modified", "Cache-Control"} {
+		h.Del(name)
+	}
+}
+
+// etagMatches reports whether an If-None-Match header lists etag. Weak
+// comparison is used, as RFC 9110 requires for If-None-Match.
+func etagMatches(ifNoneMatch, etag string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// CacheStatic sets Cache-Control and a content-hash ETag on the responses of
+// next, a handler serving the files of fsys at their paths. Embedded files
+// have no modification time, so without the ETag they could not be
+// revalidated; http.FileServer answers a matching If-None-Match with a 304.
+func CacheStatic(fsys fs.FS, next http.Handler) http.Handler {
+	etags := &staticETags{fsys: fsys, byPath: make(map[string]staticETag)}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", staticCacheControl)
+		if etag := etags.get(strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")); etag != "" {
+			w.Header().Set("ETag", etag)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// staticETags hashes each file once, and again whenever its size or
+// modification time changes, as they do when serving from disk.
+type staticETags struct {
+	fsys fs.FS
+
+	mu     sync.Mutex
+	byPath map[string]staticETag
+}
+
+type staticETag struct {
+	modTime time.Time
+	size    int64
+	etag    string
+}
+
+// get returns the ETag of the file at name, or "" if it is not a file.
+func (e *staticETags) get(name string) string {
+	info, err := fs.Stat(e.fsys, name)
+	if err != nil || !info.Mode().IsRegular() {
+		return ""
+	}
+	e.mu.Lock()
+	cached, ok := e.byPath[name]
+	e.mu.Unlock()
+	if ok && cached.modTime.Equal(info.ModTime()) && cached.size == info.Size() {
+		return cached.etag
+	}
+
+	data, err := fs.ReadFile(e.fsys, name)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	etag := `"` + hex.EncodeToString(sum[:8]) + `"`
+	e.mu.Lock()
+	e.byPath[name] = staticETag{modTime: info.ModTime(), size: info.Size(), etag: etag}
+	e.mu.Unlock()
+	return etag
+}
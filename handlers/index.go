@@ -1,12 +1,9 @@
 package groupie
 
 import (
-	"encoding/json"
-	"html/template"
-	"io"
-	"log"
+	"context"
+	"log/slog"
 	"net/http"
-	"time"
 )
 
 // Define a struct to match the structure of the API response
@@ -23,59 +20,74 @@ type Artist struct {
 }
 
 // fetchArtistData makes an HTTP GET request to the API and retrieves artist data.
-func FetchArtistData() ([]Artist, error) {
-	client := &http.Client{
-		Timeout: 20 * time.Second,
-	}
-
-	resp, err := client.Get("https://groupietrackers.herokuapp.com/api/artists")
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
-	}
-
+func FetchArtistData(ctx context.Context) ([]Artist, error) {
 	var artists []Artist
-	err = json.Unmarshal(body, &artists)
-	if err != nil {
+	if err := fetchJSON(ctx, upstream.URL("/artists"), &artists); err != nil {
 		return nil, err
 	}
 
 	return artists, nil
 }
 
-// IndexHandler handles the main page rendering and calls fetchArtistData for data retrieval.
+// IndexHandler handles the main page rendering from the cached artist data.
 func IndexHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		log.Printf("Invalid method: %s", r.Method)
-		http.Error(w, "Invalid method", http.StatusMethodNotAllowed)
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		methodNotAllowed(w, r, "GET, HEAD")
 		return
 	}
+	// Pages ignore the parameters that shape the JSON form
+	var view artistView
+	sparse := false
+	if prefersJSON(r) {
+		params := newQueryParams(r)
+		view, sparse = params.artistView()
+		if problem := params.problem(); problem != nil {
+			logInvalidParams(r.Context(), problem)
+			WriteProblem(w, r, problem)
+			return
+		}
+	}
 
-	artists, err := FetchArtistData()
+	snapshot, err := currentCache(r.Context())
 	if err != nil {
-		log.Printf("Failed to fetch artist data: %s", err)
-		ErrorHandler(w, r, http.StatusInternalServerError, []string{"Internal Server Error"})
+		slog.ErrorContext(r.Context(), "Failed to load artist data", "error", err)
+		WriteProblem(w, r, problemFor(err))
 		return
 	}
+	artists := make([]Artist, len(snapshot.Artists))
+	for i, cached := range snapshot.Artists {
+		artists[i] = cached.Artist
+	}
 
-	// Load and parse the template
-	tmpl, err := template.ParseFiles("templates/index.html")
-	if err != nil {
-		log.Printf("Failed to open template index.html: %s", err)
-		ErrorHandler(w, r, http.StatusInternalServerError, []string{"Internal Server Error"})
+	// API clients get the artist list as JSON
+	if prefersJSON(r) {
+		if setSnapshotValidators(w, r, snapshot, "json", pageCacheControl) {
+			return
+		}
+		var body any = artists
+		if sparse {
+			body = artistResources(snapshot, snapshot.Artists, view)
+		}
+		if err := writeJSON(w, http.StatusOK, "application/json", body); err != nil {
+			slog.ErrorContext(r.Context(), "Failed to encode artists", "error", err)
+		}
 		return
 	}
 
-	// Execute the template with the data
-	err = tmpl.Execute(w, artists)
+	if setSnapshotValidators(w, r, snapshot, "html", htmlCacheControl) {
+		return
+	}
+
+	// Render the pre-parsed template with the data
+	page, err := renderPage("index.html", IndexData{Artists: artists, Nonce: CSPNonce(r.Context())})
 	if err != nil {
-		log.Printf("Failed to execute template: %s", err)
-		ErrorHandler(w, r, http.StatusInternalServerError, []string{"Internal Server Error"})
+		slog.ErrorContext(r.Context(), "Failed to render template index.html", "error", err)
+		clearValidators(w.Header())
+		WriteProblem(w, r, NewProblem(http.StatusInternalServerError, "Internal Server Error"))
 		return
 	}
+
+	if _, err := w.Write(page); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to write index page", "error", err)
+	}
 }
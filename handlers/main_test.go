@@ -1,14 +1,121 @@
 package groupie
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"os"
 	"reflect"
+	"slices"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"testing/fstest"
 	"time"
 )
 
+func TestMain(m *testing.M) {
+	if err := LoadTemplates(os.DirFS("../templates"), false); err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
+
+func TestTemplateSetRendersPages(t *testing.T) {
+	page, err := renderPage("error.html", ErrorData{Code: http.StatusNotFound, Errors: []string{"Page not found"}})
+	if err != nil {
+		t.Fatalf("could not render error page: %v", err)
+	}
+	for _, want := range []string{"<title>Groupie Trackers - 404</title>", "Page not found", "/static/styles.css"} {
+		if !strings.Contains(string(page), want) {
+			t.Errorf("error page missing %q", want)
+		}
+	}
+
+	page, err = renderPage("index.html", IndexData{Artists: []Artist{{ID: 7, Name: "Queen"}}})
+	if err != nil {
+		t.Fatalf("could not render index page: %v", err)
+	}
+	for _, want := range []string{`data-name="Queen"`, `data-id="7"`, "bootstrap.bundle.min.js"} {
+		if !strings.Contains(string(page), want) {
+			t.Errorf("index page missing %q", want)
+		}
+	}
+}
+
+func TestTemplateSetDevReload(t *testing.T) {
+	fsys := fstest.MapFS{
+		"layout.html":        {Data: []byte(`{{define "layout"}}{{template "content" .}}{{end}}`)},
+		"partials/head.html": {Data: []byte(`{{define "head"}}{{end}}`)},
+		"index.html":         {Data: []byte(`{{define "content"}}v1{{end}}`)},
+		"artist.html":        {Data: []byte(`{{define "content"}}artist{{end}}`)},
+		"error.html":         {Data: []byte(`{{define "content"}}error{{end}}`)},
+	}
+	ts, err := NewTemplateSet(fsys, true)
+	if err != nil {
+		t.Fatalf("could not parse templates: %v", err)
+	}
+
+	fsys["index.html"] = &fstest.MapFile{Data: []byte(`{{define "content"}}v2{{end}}`), ModTime: time.Now().Add(time.Minute)}
+	var buf strings.Builder
+	if err := ts.Render(&buf, "index.html", nil); err != nil {
+		t.Fatalf("could not render index page: %v", err)
+	}
+	if buf.String() != "v2" {
+		t.Errorf("dev mode did not re-parse changed template: got %q want %q", buf.String(), "v2")
+	}
+}
+
+// useMockUpstream points the handlers at a mock API for the rest of the test.
+// The returned client retries without noticeable backoff.
+func useMockUpstream(t *testing.T, baseURL string) *UpstreamClient {
+	client := NewUpstreamClient(baseURL, time.Second)
+	client.BaseBackoff = time.Millisecond
+	client.MaxBackoff = time.Millisecond
+	original := SetUpstreamClient(client)
+	t.Cleanup(func() { SetUpstreamClient(original) })
+	return client
+}
+
+// snapshotFixtures are the default responses of snapshotAPI.
+var snapshotFixtures = map[string]string{
+	"/artists":   `[{"id": 1, "name": "Queen"}]`,
+	"/locations": `{"index": [{"id": 1, "locations": ["london-uk"]}]}`,
+	"/dates":     `{"index": [{"id": 1, "dates": ["2023-09-12"]}]}`,
+	"/relation":  `{"index": [{"id": 1, "datesLocations": {"london-uk": ["2023-09-12"]}}]}`,
+}
+
+// snapshotAPI is a mock upstream serving snapshotFixtures, except for the
+// paths in overrides. The cache is emptied so the next request refreshes it.
+func snapshotAPI(t *testing.T, overrides map[string]http.HandlerFunc) *UpstreamClient {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if override, ok := overrides[r.URL.Path]; ok {
+			override(w, r)
+			return
+		}
+		body, ok := snapshotFixtures[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(mockServer.Close)
+	client := useMockUpstream(t, mockServer.URL)
+	client.SetRateLimit(0, 0)
+	dataCache = DataCache{}
+	return client
+}
+
 func setupMockCacheForFilteredArtistsHandler() {
 	dataCache = DataCache{
 		Artists: []CachedArtist{
@@ -111,9 +218,12 @@ func TestFilteredArtistsHandler(t *testing.T) {
 					t.Errorf("FilteredArtistsHandler returned unexpected body: got %v want %v", got, tt.wantResponse)
 				}
 			} else if tt.wantStatus == http.StatusBadRequest {
-				expectedErrMsg := "Search query is required\n"
-				if rr.Body.String() != expectedErrMsg {
-					t.Errorf("FilteredArtistsHandler returned unexpected error message: got %v want %v", rr.Body.String(), expectedErrMsg)
+				var problem Problem
+				if err := json.NewDecoder(rr.Body).Decode(&problem); err != nil {
+					t.Fatalf("could not decode problem: %v", err)
+				}
+				if problem.Detail != "Search query is required" || len(problem.Errors) != 1 || problem.Errors[0].Field != "q" {
+					t.Errorf("FilteredArtistsHandler returned unexpected problem: %+v", problem)
 				}
 			}
 		})
@@ -188,9 +298,12 @@ func TestSearchHandler(t *testing.T) {
 					t.Errorf("SearchHandler returned unexpected body: got %v want %v", got, tt.wantResponse)
 				}
 			} else if tt.wantStatus == http.StatusBadRequest {
-				expectedErrMsg := "Search query is required\n"
-				if rr.Body.String() != expectedErrMsg {
-					t.Errorf("SearchHandler returned unexpected error message: got %v want %v", rr.Body.String(), expectedErrMsg)
+				var problem Problem
+				if err := json.NewDecoder(rr.Body).Decode(&problem); err != nil {
+					t.Fatalf("could not decode problem: %v", err)
+				}
+				if problem.Detail != "Search query is required" || len(problem.Errors) != 1 || problem.Errors[0].Field != "q" {
+					t.Errorf("SearchHandler returned unexpected problem: %+v", problem)
 				}
 			}
 		})
@@ -229,17 +342,11 @@ func TestDatesHandler(t *testing.T) {
 			// Mock response recorder
 			rr := httptest.NewRecorder()
 
-			// Create a mock server to serve the external API response
-			mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Serve the mock dates index from a mock API
+			snapshotAPI(t, map[string]http.HandlerFunc{"/dates": func(w http.ResponseWriter, r *http.Request) {
 				w.WriteHeader(tt.mockStatusCode)
 				w.Write([]byte(tt.mockResponse))
-			}))
-			defer mockServer.Close()
-
-			// Override the client temporarily
-			originalClient := http.DefaultClient
-			http.DefaultClient = mockServer.Client()
-			defer func() { http.DefaultClient = originalClient }()
+			}})
 
 			// Call the handler
 			DatesHandler(rr, req)
@@ -252,6 +359,612 @@ func TestDatesHandler(t *testing.T) {
 	}
 }
 
+func TestErrorStatusCodes(t *testing.T) {
+	tests := []struct {
+		name           string
+		handler        http.HandlerFunc
+		query          string
+		upstream       map[string]http.HandlerFunc
+		expectedStatus int
+		expectedDetail string
+	}{
+		{
+			name:           "Missing artist ID is a validation error",
+			handler:        DatesHandler,
+			query:          "",
+			expectedStatus: http.StatusBadRequest,
+			expectedDetail: "Missing artist ID",
+		},
+		{
+			name:           "Unknown artist ID is not found",
+			handler:        RelationHandler,
+			query:          "?id=99",
+			upstream:       map[string]http.HandlerFunc{},
+			expectedStatus: http.StatusNotFound,
+			expectedDetail: "Artist ID not found",
+		},
+		{
+			name:           "Upstream server error is a bad gateway",
+			handler:        DatesHandler,
+			query:          "?id=1",
+			upstream:       map[string]http.HandlerFunc{"/dates": func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusInternalServerError) }},
+			expectedStatus: http.StatusBadGateway,
+			expectedDetail: "The artist data service is unavailable",
+		},
+		{
+			name:           "Malformed upstream data is a bad gateway",
+			handler:        LocationsHandler,
+			query:          "?id=1",
+			upstream:       map[string]http.HandlerFunc{"/locations": func(w http.ResponseWriter, r *http.Request) { w.Write([]byte(`{"index": [`)) }},
+			expectedStatus: http.StatusBadGateway,
+			expectedDetail: "The artist data service returned invalid data",
+		},
+		{
+			name:    "Slow upstream is a gateway timeout",
+			handler: DatesHandler,
+			query:   "?id=1",
+			upstream: map[string]http.HandlerFunc{"/dates": func(w http.ResponseWriter, r *http.Request) {
+				time.Sleep(200 * time.Millisecond)
+				w.Write([]byte(snapshotFixtures["/dates"]))
+			}},
+			expectedStatus: http.StatusGatewayTimeout,
+			expectedDetail: "The artist data service did not respond in time",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.upstream != nil {
+				client := snapshotAPI(t, tt.upstream)
+				client.HTTPClient.Timeout = 50 * time.Millisecond
+			}
+
+			req := httptest.NewRequest("GET", "/dates"+tt.query, nil)
+			rr := httptest.NewRecorder()
+			tt.handler(rr, req)
+
+			if rr.Code != tt.expectedStatus {
+				t.Errorf("Handler returned wrong status code: got %v want %v", rr.Code, tt.expectedStatus)
+			}
+			var problem Problem
+			if err := json.NewDecoder(rr.Body).Decode(&problem); err != nil {
+				t.Fatalf("could not decode problem: %v", err)
+			}
+			if problem.Status != tt.expectedStatus || problem.Detail != tt.expectedDetail {
+				t.Errorf("Handler returned unexpected problem: %+v", problem)
+			}
+		})
+	}
+}
+
+func TestStatusCode(t *testing.T) {
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{err: &Error{Kind: ErrValidation}, want: http.StatusBadRequest},
+		{err: &Error{Kind: ErrNotFound}, want: http.StatusNotFound},
+		{err: fmt.Errorf("refresh: %w", &Error{Kind: ErrUpstreamUnavailable}), want: http.StatusBadGateway},
+		{err: &Error{Kind: ErrUpstreamMalformed}, want: http.StatusBadGateway},
+		{err: &Error{Kind: ErrUpstreamTimeout}, want: http.StatusGatewayTimeout},
+		{err: errors.New("boom"), want: http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		if got := StatusCode(tt.err); got != tt.want {
+			t.Errorf("StatusCode(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestUpstreamClientRetries(t *testing.T) {
+	calls := 0
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`[{"id": 1, "name": "Queen"}]`))
+	}))
+	defer mockServer.Close()
+	useMockUpstream(t, mockServer.URL)
+	useMetrics(t)
+
+	artists, err := FetchArtistData(context.Background())
+	if err != nil {
+		t.Fatalf("FetchArtistData failed after transient errors: %v", err)
+	}
+	if len(artists) != 1 || calls != 3 {
+		t.Errorf("got %d artists after %d calls, want 1 after 3", len(artists), calls)
+	}
+	if got := counterValue(metrics.upstreamErrors, "artists", "unavailable"); got != 0 {
+		t.Errorf("recovered call counted %v upstream failures, want 0", got)
+	}
+
+	// Client errors are not retried
+	calls = 0
+	mockServer.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusNotFound)
+	})
+	if _, err := FetchArtistData(context.Background()); err == nil || calls != 1 {
+		t.Errorf("got err %v after %d calls, want an error after 1", err, calls)
+	}
+}
+
+func TestUpstreamCircuitBreaker(t *testing.T) {
+	calls := 0
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer mockServer.Close()
+	client := useMockUpstream(t, mockServer.URL)
+	client.MaxRetries = 0
+	client.Breaker = NewCircuitBreaker(2, time.Hour)
+	useMetrics(t)
+
+	for i := 0; i < 2; i++ {
+		FetchArtistData(context.Background())
+	}
+	if state := client.Breaker.State(); state != CircuitOpen {
+		t.Fatalf("circuit is %s after repeated failures, want %s", state, CircuitOpen)
+	}
+
+	_, err := FetchArtistData(context.Background())
+	if !errors.Is(err, ErrCircuitOpen) || StatusCode(err) != http.StatusBadGateway {
+		t.Errorf("open circuit returned %v, want %v", err, ErrCircuitOpen)
+	}
+	if rejected := counterValue(metrics.upstreamErrors, "artists", "circuit_open"); calls != 2 || rejected != 1 {
+		t.Errorf("open circuit still called the API: %d calls, %v rejected", calls, rejected)
+	}
+
+	// After the cooldown a single probe goes through at a time
+	client.Breaker.Cooldown = 0
+	if !client.Breaker.Allow() || client.Breaker.Allow() {
+		t.Error("half-open circuit did not let exactly one probe through")
+	}
+	client.Breaker.Abandon()
+
+	// A successful probe closes the circuit again
+	mockServer.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[]`))
+	})
+	if _, err := FetchArtistData(context.Background()); err != nil {
+		t.Fatalf("half-open circuit did not let the call through: %v", err)
+	}
+	if state := client.Breaker.State(); state != CircuitClosed {
+		t.Errorf("circuit is %s after a success, want %s", state, CircuitClosed)
+	}
+}
+
+// artistsAPI is a mock upstream serving six artists, each with its own
+// locations URL, plus the bulk /locations index.
+func artistsAPI(t *testing.T, perArtist http.HandlerFunc) *httptest.Server {
+	var mockServer *httptest.Server
+	mockServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/artists":
+			var artists []Artist
+			for id := 1; id <= 6; id++ {
+				artists = append(artists, Artist{ID: id, Name: fmt.Sprintf("Artist %d", id), Locations: fmt.Sprintf("%s/locations/%d", mockServer.URL, id)})
+			}
+			json.NewEncoder(w).Encode(artists)
+		case r.URL.Path == "/locations":
+			w.Write([]byte(`{"index": [{"id": 1, "locations": ["bulk-1"]}, {"id": 2, "locations": ["bulk-2"]}]}`))
+		case r.URL.Path == "/dates":
+			w.Write([]byte(`{"index": [{"id": 1, "dates": ["2023-09-12"]}]}`))
+		case r.URL.Path == "/relation":
+			w.Write([]byte(`{"index": [{"id": 1, "datesLocations": {"bulk-1": ["2023-09-12"]}}]}`))
+		case strings.HasPrefix(r.URL.Path, "/locations/"):
+			perArtist(w, r)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(mockServer.Close)
+	useMockUpstream(t, mockServer.URL).SetRateLimit(0, 0)
+	return mockServer
+}
+
+func TestFetchArtistDataWithLocationsWorkers(t *testing.T) {
+	var inFlight, maxInFlight atomic.Int32
+	artistsAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			m := maxInFlight.Load()
+			if n <= m || maxInFlight.CompareAndSwap(m, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		fmt.Fprintf(w, `{"locations": ["loc-%s"]}`, strings.TrimPrefix(r.URL.Path, "/locations/"))
+	})
+	originalOptions := locationFetch
+	defer func() { locationFetch = originalOptions }()
+	SetLocationFetchOptions(LocationFetchOptions{Workers: 2})
+
+	cached, err := FetchArtistDataWithLocations(context.Background())
+	if err != nil {
+		t.Fatalf("FetchArtistDataWithLocations failed: %v", err)
+	}
+	if got := maxInFlight.Load(); got > 2 {
+		t.Errorf("%d location requests in flight, want at most 2", got)
+	}
+	for i, artist := range cached {
+		want := fmt.Sprintf("loc-%d", i+1)
+		if artist.Artist.ID != i+1 || len(artist.Locations) != 1 || artist.Locations[0] != want {
+			t.Errorf("artist %d: got %+v, want locations [%s] in order", i, artist, want)
+		}
+	}
+}
+
+func TestFetchArtistDataWithLocationsBulkIndex(t *testing.T) {
+	artistsAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("bulk mode requested per-artist URL %s", r.URL.Path)
+	})
+	originalOptions := locationFetch
+	defer func() { locationFetch = originalOptions }()
+	SetLocationFetchOptions(LocationFetchOptions{BulkIndex: true})
+
+	cached, err := FetchArtistDataWithLocations(context.Background())
+	if err != nil {
+		t.Fatalf("FetchArtistDataWithLocations failed: %v", err)
+	}
+	if len(cached) != 6 || !reflect.DeepEqual(cached[1].Locations, []string{"bulk-2"}) || len(cached[5].Locations) != 0 {
+		t.Errorf("unexpected cached artists: %+v", cached)
+	}
+}
+
+func TestUpstreamValidation(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/artists":
+			w.Write([]byte(`[{"id": 1, "name": "Queen"}, {"id": 1, "name": "Queen again"}, {"id": 0, "name": "Zero"}, {"id": 2, "name": " "}, {"id": 3, "name": "Pink Floyd"}]`))
+		case "/locations":
+			w.Write([]byte(`{"index": [{"id": 1, "locations": ["london-uk"]}, {"id": 3, "locations": ["paris-france"]}, {"id": 3, "locations": ["dup"]}]}`))
+		case "/dates":
+			w.Write([]byte(`{"index": [{"id": 1, "dates": ["2023-09-12"]}, {"id": 3, "dates": ["2023-10-01"]}, {"id": 9, "dates": ["2023-11-01"]}]}`))
+		case "/relation":
+			w.Write([]byte(`{"index": [{"id": 1, "datesLocations": {"london-uk": ["2023-09-12"]}}]}`))
+		}
+	}))
+	defer mockServer.Close()
+	useMockUpstream(t, mockServer.URL)
+	originalOptions := locationFetch
+	defer func() { locationFetch = originalOptions }()
+	SetLocationFetchOptions(LocationFetchOptions{BulkIndex: true})
+
+	cached, err := FetchArtistDataWithLocations(context.Background())
+	if err != nil {
+		t.Fatalf("FetchArtistDataWithLocations failed: %v", err)
+	}
+	if len(cached) != 2 || cached[0].Artist.Name != "Queen" || cached[1].Artist.Name != "Pink Floyd" {
+		t.Errorf("invalid artists were not rejected: %+v", cached)
+	}
+	if !reflect.DeepEqual(cached[1].Locations, []string{"paris-france"}) {
+		t.Errorf("duplicate location entry was not rejected: %v", cached[1].Locations)
+	}
+
+	summary := dataCache.Validation
+	wantResources := map[string]ResourceSummary{
+		ResourceArtists:   {Checked: 5, Rejected: 3},
+		ResourceLocations: {Checked: 3, Rejected: 1},
+		ResourceDates:     {Checked: 3, Rejected: 0},
+		ResourceRelations: {Checked: 1, Rejected: 0},
+	}
+	if !reflect.DeepEqual(summary.Resources, wantResources) {
+		t.Errorf("unexpected validation counts: %v", summary.Resources)
+	}
+	wantIssues := []RecordIssue{
+		{Resource: ResourceArtists, ID: 1, Field: "id", Message: "is duplicated", Rejected: true},
+		{Resource: ResourceArtists, ID: 0, Field: "id", Message: "must be a positive integer", Rejected: true},
+		{Resource: ResourceArtists, ID: 2, Field: "name", Message: "is required", Rejected: true},
+		{Resource: ResourceLocations, ID: 3, Field: "id", Message: "is duplicated", Rejected: true},
+		{Resource: ResourceArtists, ID: 3, Field: ResourceRelations, Message: "has no matching relation entry"},
+		{Resource: ResourceDates, ID: 9, Field: "id", Message: "matches no artist"},
+	}
+	if !reflect.DeepEqual(summary.Issues, wantIssues) {
+		t.Errorf("unexpected validation issues:\ngot  %+v\nwant %+v", summary.Issues, wantIssues)
+	}
+}
+
+func TestUpstreamValidationRejectsEmptyData(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[{"id": 0}]`))
+	}))
+	defer mockServer.Close()
+	useMockUpstream(t, mockServer.URL)
+
+	_, err := FetchArtistDataWithLocations(context.Background())
+	if !errors.Is(err, ErrUpstreamMalformed) {
+		t.Errorf("FetchArtistDataWithLocations returned %v, want %v", err, ErrUpstreamMalformed)
+	}
+}
+
+func TestConditionalRefresh(t *testing.T) {
+	bodies := map[string]string{
+		"/artists":   `[{"id": 1, "name": "Queen"}]`,
+		"/locations": `{"index": [{"id": 1, "locations": ["london-uk"]}]}`,
+		"/dates":     `{"index": [{"id": 1, "dates": ["2023-09-12"]}]}`,
+		"/relation":  `{"index": [{"id": 1, "datesLocations": {"london-uk": ["2023-09-12"]}}]}`,
+	}
+	versions := map[string]int{"/artists": 1, "/locations": 1, "/dates": 1, "/relation": 1}
+	failing := map[string]bool{}
+	var all, full atomic.Int32
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		all.Add(1)
+		if failing[r.URL.Path] {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		etag := fmt.Sprintf(`"%s-%d"`, r.URL.Path, versions[r.URL.Path])
+		w.Header().Set("ETag", etag)
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		full.Add(1)
+		w.Write([]byte(bodies[r.URL.Path]))
+	}))
+	defer mockServer.Close()
+	useMockUpstream(t, mockServer.URL)
+	useMetrics(t)
+	originalOptions := locationFetch
+	defer func() { locationFetch = originalOptions }()
+	SetLocationFetchOptions(LocationFetchOptions{BulkIndex: true})
+
+	if _, err := FetchArtistDataWithLocations(context.Background()); err != nil {
+		t.Fatalf("first refresh failed: %v", err)
+	}
+	// A rebuild would replace this marker with the upstream name
+	dataCache.Artists[0].Artist.Name = "kept"
+	firstFetched := dataCache.LastFetched
+
+	if _, err := FetchArtistDataWithLocations(context.Background()); err != nil {
+		t.Fatalf("second refresh failed: %v", err)
+	}
+	if dataCache.Artists[0].Artist.Name != "kept" || !dataCache.LastFetched.After(firstFetched) {
+		t.Errorf("unchanged upstream data was rebuilt: %+v", dataCache.Artists[0])
+	}
+	if notModified := all.Load() - full.Load(); notModified != 4 || full.Load() != 4 {
+		t.Errorf("got %d not modified responses and %d full ones, want 4 and 4", notModified, full.Load())
+	}
+	if got := counterValue(metrics.cacheRefreshes, "not_modified"); got != 1 {
+		t.Errorf("counted %v not modified refreshes, want 1", got)
+	}
+
+	// Only the artists changed: the other indexes are reused from the stored bodies
+	bodies["/artists"] = `[{"id": 1, "name": "Queen II"}]`
+	versions["/artists"] = 2
+	cached, err := FetchArtistDataWithLocations(context.Background())
+	if err != nil {
+		t.Fatalf("third refresh failed: %v", err)
+	}
+	if cached[0].Artist.Name != "Queen II" || !reflect.DeepEqual(cached[0].Locations, []string{"london-uk"}) || len(dataCache.Dates[1]) != 1 {
+		t.Errorf("partial change did not rebuild from stored responses: %+v, dates %v", cached, dataCache.Dates)
+	}
+
+	// A refresh failing after the new artists were stored must not make the
+	// next one take them as already cached
+	bodies["/artists"] = `[{"id": 1, "name": "Queen III"}]`
+	versions["/artists"] = 3
+	failing["/dates"] = true
+	if _, err := FetchArtistDataWithLocations(context.Background()); err == nil {
+		t.Fatal("refresh succeeded although /dates failed")
+	}
+	failing["/dates"] = false
+	cached, err = FetchArtistDataWithLocations(context.Background())
+	if err != nil {
+		t.Fatalf("refresh after a failed one failed: %v", err)
+	}
+	if cached[0].Artist.Name != "Queen III" {
+		t.Errorf("refresh after a failed one kept stale data: %+v", cached)
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	start := time.Now()
+	b := newTokenBucket(2, 2)
+	waits := []time.Duration{
+		b.reserve(start),
+		b.reserve(start),
+		b.reserve(start),
+		b.reserve(start.Add(time.Second)),
+	}
+	want := []time.Duration{0, 0, 500 * time.Millisecond, 0}
+	if !reflect.DeepEqual(waits, want) {
+		t.Errorf("token bucket waits = %v, want %v", waits, want)
+	}
+}
+
+func TestTokenBucketAllow(t *testing.T) {
+	start := time.Now()
+	b := newTokenBucket(2, 1)
+	if ok, _ := b.allow(start); !ok {
+		t.Fatal("first request was refused")
+	}
+	// A refused request must not push the next token further away
+	for range 3 {
+		if ok, wait := b.allow(start); ok || wait != 500*time.Millisecond {
+			t.Errorf("allow() = %t, %v; want false, 500ms", ok, wait)
+		}
+	}
+	if ok, _ := b.allow(start.Add(500 * time.Millisecond)); !ok {
+		t.Error("request after the refill was refused")
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	trusted := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("::1/128")}
+	tests := []struct {
+		name      string
+		remote    string
+		forwarded []string
+		want      string
+	}{
+		{name: "Direct", remote: "203.0.113.7:51000", want: "203.0.113.7"},
+		{name: "Untrusted peer", remote: "203.0.113.7:51000", forwarded: []string{"198.51.100.1"}, want: "203.0.113.7"},
+		{name: "Trusted proxy", remote: "10.0.0.2:51000", forwarded: []string{"198.51.100.1"}, want: "198.51.100.1"},
+		{name: "Spoofed entry ignored", remote: "10.0.0.2:51000", forwarded: []string{"1.2.3.4, 198.51.100.1"}, want: "198.51.100.1"},
+		{name: "Proxy chain", remote: "[::1]:51000", forwarded: []string{"198.51.100.1", "10.0.0.9"}, want: "198.51.100.1"},
+		{name: "Malformed entry", remote: "10.0.0.2:51000", forwarded: []string{"198.51.100.1, unknown, 10.0.0.9"}, want: "10.0.0.9"},
+		{name: "Only proxies", remote: "10.0.0.2:51000", forwarded: []string{"10.0.0.9"}, want: "10.0.0.9"},
+		{name: "No header", remote: "10.0.0.2:51000", want: "10.0.0.2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/search?q=a", nil)
+			req.RemoteAddr = tt.remote
+			for _, v := range tt.forwarded {
+				req.Header.Add("X-Forwarded-For", v)
+			}
+			if got := clientIP(req, trusted); got != tt.want {
+				t.Errorf("clientIP() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	if a, b := clientKey("2001:db8::1"), clientKey("2001:db8::2"); a != b {
+		t.Errorf("addresses in one /64 have keys %q and %q", a, b)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	h := RateLimiter(RateLimitOptions{
+		Search: RateLimit{Rate: 1, Burst: 2},
+		API:    RateLimit{Rate: 1, Burst: 3},
+	})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	serve := func(path, remote string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		req.RemoteAddr = remote
+		req.Header.Set("Accept", "text/html,*/*;q=0.8")
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		return rr
+	}
+
+	var codes []int
+	for range 3 {
+		codes = append(codes, serve("/search?q=a", "192.0.2.1:1000").Code)
+	}
+	if want := []int{200, 200, 429}; !reflect.DeepEqual(codes, want) {
+		t.Errorf("search statuses = %v, want %v", codes, want)
+	}
+	rr := serve("/getArtists", "192.0.2.1:1001")
+	if rr.Code != http.StatusTooManyRequests || rr.Header().Get("Retry-After") != "1" {
+		t.Errorf("got %d with Retry-After %q, want 429 with 1", rr.Code, rr.Header().Get("Retry-After"))
+	}
+	// API routes answer JSON even to a browser, pages answer HTML
+	var p Problem
+	if ct := rr.Header().Get("Content-Type"); ct != "application/problem+json" {
+		t.Errorf("429 Content-Type = %q, want application/problem+json", ct)
+	}
+	if err := json.NewDecoder(rr.Body).Decode(&p); err != nil || p.Status != http.StatusTooManyRequests {
+		t.Errorf("429 body = %+v, %v", p, err)
+	}
+	for range 3 {
+		serve("/artist/1", "192.0.2.3:1000")
+	}
+	if rr := serve("/", "192.0.2.3:1000"); rr.Code != http.StatusTooManyRequests || !strings.HasPrefix(rr.Header().Get("Content-Type"), "text/html") {
+		t.Errorf("page got %d with Content-Type %q, want an HTML 429", rr.Code, rr.Header().Get("Content-Type"))
+	}
+
+	if code := serve("/search?q=a", "192.0.2.2:1000").Code; code != http.StatusOK {
+		t.Errorf("another client got %d", code)
+	}
+	if code := serve("/dates?id=1", "192.0.2.1:1000").Code; code != http.StatusOK {
+		t.Errorf("API route shares the search limit: got %d", code)
+	}
+	for _, path := range []string{"/healthz", "/readyz", "/metrics"} {
+		for range 5 {
+			if code := serve(path, "192.0.2.1:1000").Code; code != http.StatusOK {
+				t.Fatalf("%s got %d, want it exempt", path, code)
+			}
+		}
+	}
+}
+
+func TestHandlerCancellation(t *testing.T) {
+	upstreamCanceled := make(chan struct{})
+	snapshotAPI(t, map[string]http.HandlerFunc{"/locations": func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+			close(upstreamCanceled)
+		case <-time.After(5 * time.Second):
+		}
+	}})
+
+	// The client closes the modal while the handler waits on the upstream
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	req := httptest.NewRequest("GET", "/locations?id=1", nil).WithContext(ctx)
+	rr := httptest.NewRecorder()
+
+	start := time.Now()
+	LocationsHandler(rr, req)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("LocationsHandler took %v after the request was canceled", elapsed)
+	}
+	if rr.Code != StatusClientClosedRequest {
+		t.Errorf("Handler returned wrong status code: got %v want %v", rr.Code, StatusClientClosedRequest)
+	}
+	select {
+	case <-upstreamCanceled:
+	case <-time.After(time.Second):
+		t.Error("upstream request was not canceled")
+	}
+}
+
+func TestRequestRefreshTimeout(t *testing.T) {
+	snapshotAPI(t, map[string]http.HandlerFunc{"/artists": func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}})
+	upstream.MaxRetries = 0
+	original := refreshTimeout
+	SetRefreshTimeout(50 * time.Millisecond)
+	t.Cleanup(func() { SetRefreshTimeout(original) })
+
+	start := time.Now()
+	rr := httptest.NewRecorder()
+	DatesHandler(rr, httptest.NewRequest("GET", "/dates?id=1", nil))
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("request waited %v for the refresh", elapsed)
+	}
+	if rr.Code != http.StatusGatewayTimeout {
+		t.Errorf("got status %d, want %d", rr.Code, http.StatusGatewayTimeout)
+	}
+}
+
+func TestFetchArtistDataWithLocationsCancellation(t *testing.T) {
+	var requests atomic.Int32
+	ctx, cancel := context.WithCancel(context.Background())
+	artistsAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		// Shutdown starts while the first location requests are in flight
+		if requests.Add(1) == 1 {
+			cancel()
+		}
+		<-r.Context().Done()
+	})
+	originalOptions := locationFetch
+	defer func() { locationFetch = originalOptions }()
+	SetLocationFetchOptions(LocationFetchOptions{Workers: 2})
+	dataCache = DataCache{}
+
+	if _, err := FetchArtistDataWithLocations(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("FetchArtistDataWithLocations returned %v, want %v", err, context.Canceled)
+	}
+	if got := requests.Load(); got > 2 {
+		t.Errorf("%d location requests sent after cancellation, want at most 2", got)
+	}
+	if !dataCache.LastFetched.IsZero() {
+		t.Error("canceled refresh updated the cache")
+	}
+}
+
 func TestLocationsHandler(t *testing.T) {
 	tests := []struct {
 		name           string
@@ -264,6 +977,7 @@ func TestLocationsHandler(t *testing.T) {
 			name:           "Artist ID found",
 			query:          "?id=1",
 			mockResponse:   `{"index": [{"id": 1, "locations": ["New York", "Los Angeles"], "dates": "2023-09-12"}]}`,
+			mockStatusCode: http.StatusOK,
 			expectedStatus: http.StatusOK,
 		},
 	}
@@ -274,14 +988,11 @@ func TestLocationsHandler(t *testing.T) {
 				t.Fatalf("Failed to create request: %v", err)
 			}
 			rr := httptest.NewRecorder()
-			// Mock HTTP server to return the appropriate response
-			mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Mock API returning the appropriate locations index
+			snapshotAPI(t, map[string]http.HandlerFunc{"/locations": func(w http.ResponseWriter, r *http.Request) {
 				w.WriteHeader(tt.mockStatusCode)
 				w.Write([]byte(tt.mockResponse))
-			}))
-			defer mockServer.Close()
-			// Replace the external API call with a call to the mock server
-			http.DefaultClient = mockServer.Client()
+			}})
 			LocationsHandler(rr, req)
 			if status := rr.Code; status != tt.expectedStatus {
 				t.Errorf("Handler returned wrong status code: got %v want %v", status, tt.expectedStatus)
@@ -315,15 +1026,12 @@ func TestRelationHandler(t *testing.T) {
 			}
 			// Create a response recorder to capture the handler's response
 			rr := httptest.NewRecorder()
-			// Mock HTTP server to return the appropriate mock response
-			mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Mock API returning the appropriate relation index
+			// To simulate calling the real API endpoint but with a mock response
+			snapshotAPI(t, map[string]http.HandlerFunc{"/relation": func(w http.ResponseWriter, r *http.Request) {
 				w.WriteHeader(tt.mockStatusCode)
 				w.Write([]byte(tt.mockResponse))
-			}))
-			defer mockServer.Close()
-			// Replace the external API call with a call to the mock server
-			// To simulate calling the real API endpoint but with a mock response
-			http.DefaultClient = mockServer.Client()
+			}})
 			// Call the handler
 			RelationHandler(rr, req)
 			// Check if the status code is what we expect
@@ -333,3 +1041,1160 @@ func TestRelationHandler(t *testing.T) {
 		})
 	}
 }
+
+func TestPrefersJSON(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   bool
+	}{
+		{accept: "", want: false},
+		{accept: "*/*", want: false},
+		{accept: "application/json", want: true},
+		{accept: "application/problem+json", want: true},
+		{accept: "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", want: false},
+		{accept: "application/json, text/html;q=0.5", want: true},
+		{accept: "text/html, application/json;q=0.9", want: false},
+		{accept: "application/*, text/html;q=0.1", want: true},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Accept", tt.accept)
+		if got := prefersJSON(req); got != tt.want {
+			t.Errorf("prefersJSON(%q) = %v, want %v", tt.accept, got, tt.want)
+		}
+	}
+}
+
+func TestWriteProblem(t *testing.T) {
+	tests := []struct {
+		name        string
+		path        string
+		accept      string
+		wantType    string
+		wantContent string
+	}{
+		{name: "Client asking for JSON", path: "/artist/x", accept: "application/json", wantType: "application/problem+json", wantContent: `"instance":"/artist/x"`},
+		{name: "Field errors", path: "/missing", accept: "application/problem+json", wantType: "application/problem+json", wantContent: `"field":"id"`},
+		{name: "Browser route", path: "/missing", accept: "text/html", wantType: "text/html; charset=utf-8", wantContent: "<li>id: must be an integer</li>"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tt.path, nil)
+			req.Header.Set("Accept", tt.accept)
+			rr := httptest.NewRecorder()
+			WriteProblem(rr, req, ValidationProblem("Invalid artist ID", FieldError{Field: "id", Message: "must be an integer"}))
+
+			if rr.Code != http.StatusBadRequest {
+				t.Errorf("WriteProblem returned wrong status code: got %v want %v", rr.Code, http.StatusBadRequest)
+			}
+			if ct := rr.Header().Get("Content-Type"); ct != tt.wantType {
+				t.Errorf("WriteProblem returned wrong content type: got %v want %v", ct, tt.wantType)
+			}
+			if !strings.Contains(rr.Body.String(), tt.wantContent) {
+				t.Errorf("WriteProblem body missing %q: %s", tt.wantContent, rr.Body.String())
+			}
+		})
+	}
+}
+
+func TestArtistHandler(t *testing.T) {
+	setupMockCache()
+	dataCache.Artists[0].Artist.ID = 3
+
+	tests := []struct {
+		name       string
+		path       string
+		accept     string
+		wantStatus int
+		wantBody   string
+	}{
+		{name: "HTML page", path: "/artist/3", accept: "text/html", wantStatus: http.StatusOK, wantBody: "<li>Location A</li>"},
+		{name: "JSON document", path: "/artist/3", accept: "application/json", wantStatus: http.StatusOK, wantBody: `"Locations":["Location A","Location B"]`},
+		{name: "Unknown artist", path: "/artist/4", accept: "application/json", wantStatus: http.StatusNotFound, wantBody: `"status":404`},
+		{name: "Invalid artist ID", path: "/artist/abc", accept: "text/html", wantStatus: http.StatusBadRequest, wantBody: "Invalid artist ID"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tt.path, nil)
+			req.Header.Set("Accept", tt.accept)
+			rr := httptest.NewRecorder()
+			ArtistHandler(rr, req)
+
+			if rr.Code != tt.wantStatus {
+				t.Errorf("ArtistHandler returned wrong status code: got %v want %v", rr.Code, tt.wantStatus)
+			}
+			if !strings.Contains(rr.Body.String(), tt.wantBody) {
+				t.Errorf("ArtistHandler body missing %q: %s", tt.wantBody, rr.Body.String())
+			}
+		})
+	}
+}
+
+func TestSnapshotValidators(t *testing.T) {
+	snapshotAPI(t, nil)
+	updated := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	get := func(handler http.HandlerFunc, target string, header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", target, nil)
+		for key, values := range header {
+			req.Header[key] = values
+		}
+		rr := httptest.NewRecorder()
+		handler(rr, req)
+		return rr
+	}
+
+	first := get(DatesHandler, "/dates?id=1", nil)
+	etag := first.Header().Get("ETag")
+	if first.Code != http.StatusOK || !strings.HasPrefix(etag, `"`) {
+		t.Fatalf("first response: status %d, ETag %q, want a strong one", first.Code, etag)
+	}
+	if got := first.Header().Get("Cache-Control"); got != apiCacheControl {
+		t.Errorf("Cache-Control = %q, want %q", got, apiCacheControl)
+	}
+
+	// Pin the snapshot time so Last-Modified can be compared
+	cacheMu.Lock()
+	dataCache.UpdatedAt = updated
+	cacheMu.Unlock()
+
+	tests := []struct {
+		name       string
+		handler    http.HandlerFunc
+		target     string
+		header     http.Header
+		wantStatus int
+	}{
+		{name: "Matching ETag", handler: DatesHandler, target: "/dates?id=1", header: http.Header{"If-None-Match": {etag}}, wantStatus: http.StatusNotModified},
+		{name: "Weak matching ETag", handler: DatesHandler, target: "/dates?id=1", header: http.Header{"If-None-Match": {`"other", W/` + etag}}, wantStatus: http.StatusNotModified},
+		{name: "Stale ETag", handler: DatesHandler, target: "/dates?id=1", header: http.Header{"If-None-Match": {`"other"`}}, wantStatus: http.StatusOK},
+		{name: "Not modified since", handler: LocationsHandler, target: "/locations?id=1", header: http.Header{"If-Modified-Since": {updated.Format(http.TimeFormat)}}, wantStatus: http.StatusNotModified},
+		{name: "Modified since", handler: LocationsHandler, target: "/locations?id=1", header: http.Header{"If-Modified-Since": {updated.Add(-time.Hour).Format(http.TimeFormat)}}, wantStatus: http.StatusOK},
+		{name: "ETag wins over date", handler: LocationsHandler, target: "/locations?id=1", header: http.Header{"If-None-Match": {`"other"`}, "If-Modified-Since": {updated.Format(http.TimeFormat)}}, wantStatus: http.StatusOK},
+		{name: "HTML and JSON differ", handler: IndexHandler, target: "/", header: http.Header{"Accept": {"text/html"}, "If-None-Match": {etag}}, wantStatus: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := get(tt.handler, tt.target, tt.header)
+			if rr.Code != tt.wantStatus {
+				t.Errorf("got status %d, want %d", rr.Code, tt.wantStatus)
+			}
+			if rr.Code == http.StatusNotModified && rr.Body.Len() != 0 {
+				t.Errorf("304 response has a body: %q", rr.Body.String())
+			}
+		})
+	}
+
+	page := get(IndexHandler, "/", http.Header{"Accept": {"text/html"}})
+	if got := page.Header().Get("Cache-Control"); got != htmlCacheControl {
+		t.Errorf("page Cache-Control = %q, want %q", got, htmlCacheControl)
+	}
+	if got := page.Header().Get("ETag"); !strings.HasPrefix(got, `W/"`) {
+		t.Errorf("page ETag = %q, want a weak one", got)
+	}
+	if got := page.Header().Get("Last-Modified"); got != updated.Format(http.TimeFormat) {
+		t.Errorf("page Last-Modified = %q, want %q", got, updated.Format(http.TimeFormat))
+	}
+	if again := get(IndexHandler, "/", http.Header{"Accept": {"text/html"}, "If-None-Match": {page.Header().Get("ETag")}}); again.Code != http.StatusNotModified {
+		t.Errorf("revalidated page got status %d, want 304", again.Code)
+	}
+	if data := get(IndexHandler, "/", http.Header{"Accept": {"application/json"}}); data.Header().Get("Cache-Control") != pageCacheControl || strings.HasPrefix(data.Header().Get("ETag"), "W/") {
+		t.Errorf("page JSON got Cache-Control %q and ETag %q, want %q and a strong one", data.Header().Get("Cache-Control"), data.Header().Get("ETag"), pageCacheControl)
+	}
+}
+
+func TestRenderFailureDropsValidators(t *testing.T) {
+	snapshotAPI(t, nil)
+	broken, err := NewTemplateSet(fstest.MapFS{
+		"layout.html":        {Data: []byte(`{{define "layout"}}{{template "content" .}}{{end}}`)},
+		"partials/head.html": {Data: []byte(`{{define "head"}}{{end}}`)},
+		"index.html":         {Data: []byte(`{{define "content"}}{{.Missing}}{{end}}`)},
+		"artist.html":        {Data: []byte(`{{define "content"}}{{.Missing}}{{end}}`)},
+		"error.html":         {Data: []byte(`{{define "content"}}error{{end}}`)},
+	}, false)
+	if err != nil {
+		t.Fatalf("could not parse templates: %v", err)
+	}
+	original := templates
+	templates = broken
+	t.Cleanup(func() { templates = original })
+
+	for _, tt := range []struct {
+		handler http.HandlerFunc
+		target  string
+	}{{IndexHandler, "/"}, {ArtistHandler, "/artist/1"}} {
+		req := httptest.NewRequest("GET", tt.target, nil)
+		req.Header.Set("Accept", "text/html")
+		rr := httptest.NewRecorder()
+		tt.handler(rr, req)
+		if rr.Code != http.StatusInternalServerError {
+			t.Errorf("%s got status %d, want 500", tt.target, rr.Code)
+		}
+		for _, name := range []string{"ETag", "Last-Modified", "Cache-Control"} {
+			if got := rr.Header().Get(name); got != "" {
+				t.Errorf("%s error page has %s %q", tt.target, name, got)
+			}
+		}
+	}
+}
+
+func TestCacheStatic(t *testing.T) {
+	fsys := fstest.MapFS{"styles.css": {Data: []byte("body {}")}}
+	handler := CacheStatic(fsys, http.FileServer(http.FS(fsys)))
+	get := func(target, ifNoneMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", target, nil)
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := get("/styles.css", "")
+	etag := rr.Header().Get("ETag")
+	if rr.Code != http.StatusOK || rr.Header().Get("Cache-Control") != staticCacheControl || !strings.HasPrefix(etag, `"`) {
+		t.Fatalf("got status %d, Cache-Control %q and ETag %q", rr.Code, rr.Header().Get("Cache-Control"), etag)
+	}
+	if rr := get("/styles.css", etag); rr.Code != http.StatusNotModified {
+		t.Errorf("revalidation got status %d, want 304", rr.Code)
+	}
+
+	// An edited file on disk gets a new ETag
+	fsys["styles.css"] = &fstest.MapFile{Data: []byte("body { margin: 0; }"), ModTime: time.Now()}
+	if rr := get("/styles.css", etag); rr.Code != http.StatusOK || rr.Header().Get("ETag") == etag {
+		t.Errorf("changed file got status %d and ETag %q, want 200 and a new ETag", rr.Code, rr.Header().Get("ETag"))
+	}
+	if rr := get("/missing.css", ""); rr.Code != http.StatusNotFound || rr.Header().Get("ETag") != "" {
+		t.Errorf("missing file got status %d and ETag %q", rr.Code, rr.Header().Get("ETag"))
+	}
+}
+
+func TestCompress(t *testing.T) {
+	large := strings.Repeat(`{"name": "Queen"}`, 100)
+	serve := func(contentType, body string, code int) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if contentType != "" {
+				w.Header().Set("Content-Type", contentType)
+			}
+			w.Header().Set("ETag", `"v1-json"`)
+			// Leave a 200 implicit so the body can be sniffed
+			if code != http.StatusOK {
+				w.WriteHeader(code)
+			}
+			io.WriteString(w, body)
+		}
+	}
+	static := http.FileServer(http.FS(fstest.MapFS{
+		"background.jpg": {Data: bytes.Repeat([]byte{0xff, 0xd8, 0xff}, 400)},
+		"styles.css":     {Data: []byte(strings.Repeat("body { margin: 0; }\n", 50))},
+		"tiny.css":       {Data: []byte("body {}")},
+	}))
+
+	tests := []struct {
+		name           string
+		handler        http.Handler
+		path           string
+		method         string
+		acceptEncoding string
+		header         http.Header
+		wantEncoding   string
+		wantETag       string
+		wantNoETag     bool
+		wantStatus     int
+	}{
+		{name: "JSON gzipped", handler: serve("application/json", large, 200), path: "/getArtists", acceptEncoding: "gzip, deflate, br", wantEncoding: "gzip", wantETag: `"v1-json-gzip"`},
+		{name: "Sniffed HTML gzipped", handler: serve("", "<!DOCTYPE html>"+large, 200), path: "/", acceptEncoding: "gzip", wantEncoding: "gzip"},
+		{name: "No Accept-Encoding", handler: serve("application/json", large, 200), path: "/getArtists", wantETag: `"v1-json"`},
+		{name: "gzip refused", handler: serve("application/json", large, 200), path: "/getArtists", acceptEncoding: "gzip;q=0, *"},
+		{name: "Wildcard accepted", handler: serve("application/json", large, 200), path: "/getArtists", acceptEncoding: "*", wantEncoding: "gzip"},
+		{name: "Problem document gzipped", handler: serve("application/problem+json", large, 502), path: "/search", acceptEncoding: "gzip", wantEncoding: "gzip", wantStatus: 502},
+		{name: "JPEG left alone", handler: static, path: "/background.jpg", acceptEncoding: "gzip"},
+		{name: "CSS gzipped", handler: static, path: "/styles.css", acceptEncoding: "gzip", wantEncoding: "gzip", wantNoETag: true},
+		{name: "Small file left alone", handler: static, path: "/tiny.css", acceptEncoding: "gzip"},
+		{name: "Range request left alone", handler: static, path: "/styles.css", acceptEncoding: "gzip", header: http.Header{"Range": {"bytes=0-9"}}, wantStatus: http.StatusPartialContent},
+		{name: "HEAD gets the GET headers", handler: serve("application/json", large, 200), path: "/getArtists", method: "HEAD", acceptEncoding: "gzip", wantEncoding: "gzip"},
+		{
+			name: "Not modified keeps the gzip ETag",
+			handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Header.Get("If-None-Match") != `"v1-json"` {
+					t.Errorf("handler saw If-None-Match %q", r.Header.Get("If-None-Match"))
+				}
+				w.Header().Set("ETag", `"v1-json"`)
+				w.WriteHeader(http.StatusNotModified)
+			}),
+			path:           "/dates?id=1",
+			acceptEncoding: "gzip",
+			header:         http.Header{"If-None-Match": {`"v1-json-gzip"`}},
+			wantETag:       `"v1-json-gzip"`,
+			wantStatus:     http.StatusNotModified,
+		},
+		{
+			name: "Weak ETag stays weak",
+			handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/html")
+				w.Header().Set("ETag", `W/"v1-html"`)
+				io.WriteString(w, large)
+			}),
+			path:           "/",
+			acceptEncoding: "gzip",
+			wantEncoding:   "gzip",
+			wantETag:       `W/"v1-html-gzip"`,
+		},
+		{
+			name: "Weak ETag revalidated",
+			handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Header.Get("If-None-Match") != `W/"v1-html"` {
+					t.Errorf("handler saw If-None-Match %q", r.Header.Get("If-None-Match"))
+				}
+				w.Header().Set("ETag", `W/"v1-html"`)
+				w.WriteHeader(http.StatusNotModified)
+			}),
+			path:           "/",
+			acceptEncoding: "gzip",
+			header:         http.Header{"If-None-Match": {`W/"v1-html-gzip"`}},
+			wantETag:       `W/"v1-html-gzip"`,
+			wantStatus:     http.StatusNotModified,
+		},
+		{
+			name: "Not modified without an ETag",
+			handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT")
+				w.WriteHeader(http.StatusNotModified)
+			}),
+			path:           "/dates?id=1",
+			acceptEncoding: "gzip",
+			wantNoETag:     true,
+			wantStatus:     http.StatusNotModified,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method := tt.method
+			if method == "" {
+				method = "GET"
+			}
+			req := httptest.NewRequest(method, tt.path, nil)
+			for key, values := range tt.header {
+				req.Header[key] = values
+			}
+			if tt.acceptEncoding != "" {
+				req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			}
+			rr := httptest.NewRecorder()
+			Compress(tt.handler).ServeHTTP(rr, req)
+
+			wantStatus := tt.wantStatus
+			if wantStatus == 0 {
+				wantStatus = http.StatusOK
+			}
+			if rr.Code != wantStatus {
+				t.Errorf("got status %d, want %d", rr.Code, wantStatus)
+			}
+			if got := rr.Header().Get("Content-Encoding"); got != tt.wantEncoding {
+				t.Errorf("Content-Encoding = %q, want %q", got, tt.wantEncoding)
+			}
+			if !strings.Contains(rr.Header().Get("Vary"), "Accept-Encoding") {
+				t.Errorf("Vary = %q, want it to list Accept-Encoding", rr.Header().Get("Vary"))
+			}
+			if tt.wantETag != "" && rr.Header().Get("ETag") != tt.wantETag {
+				t.Errorf("ETag = %q, want %q", rr.Header().Get("ETag"), tt.wantETag)
+			}
+			if _, ok := rr.Header()["Etag"]; ok && tt.wantNoETag {
+				t.Errorf("ETag = %q, want none", rr.Header().Get("ETag"))
+			}
+			if tt.wantEncoding == "gzip" && method == "GET" {
+				if rr.Header().Get("Content-Length") != "" {
+					t.Error("gzipped response kept the plain Content-Length")
+				}
+				if rr.Header().Get("Accept-Ranges") != "" {
+					t.Error("gzipped response still accepts byte ranges")
+				}
+				zr, err := gzip.NewReader(rr.Body)
+				if err != nil {
+					t.Fatalf("body is not gzipped: %v", err)
+				}
+				if body, err := io.ReadAll(zr); err != nil || len(body) < compressMinSize {
+					t.Errorf("could not decompress body: %d bytes, %v", len(body), err)
+				}
+			}
+		})
+	}
+}
+
+func TestChain(t *testing.T) {
+	var order []string
+	named := func(name string) Middleware {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				order = append(order, name)
+				next.ServeHTTP(w, r)
+			})
+		}
+	}
+	h := Chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { order = append(order, "handler") }), named("outer"), named("inner"))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if want := []string{"outer", "inner", "handler"}; !reflect.DeepEqual(order, want) {
+		t.Errorf("middleware ran in order %v, want %v", order, want)
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	tests := []struct {
+		name     string
+		incoming string
+		reused   bool
+	}{
+		{name: "Generated", incoming: ""},
+		{name: "Reused from proxy", incoming: "abc-123.def_4", reused: true},
+		{name: "Unsafe ID replaced", incoming: "abc\ninjected=1"},
+		{name: "Overlong ID replaced", incoming: strings.Repeat("a", 65)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var seen string
+			h := RequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { seen = RequestIDFrom(r.Context()) }))
+			req := httptest.NewRequest("GET", "/", nil)
+			if tt.incoming != "" {
+				req.Header.Set(RequestIDHeader, tt.incoming)
+			}
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, req)
+
+			if seen == "" || rr.Header().Get(RequestIDHeader) != seen {
+				t.Errorf("handler saw ID %q, response carries %q", seen, rr.Header().Get(RequestIDHeader))
+			}
+			if (seen == tt.incoming) != tt.reused {
+				t.Errorf("ID %q from incoming %q, want reused = %v", seen, tt.incoming, tt.reused)
+			}
+		})
+	}
+}
+
+// captureLogs sends the default logger's records, at every level, to the
+// returned buffer for the rest of the test.
+func captureLogs(t *testing.T, format string) *bytes.Buffer {
+	var buf bytes.Buffer
+	logger, err := NewLogger(&buf, format, slog.LevelDebug)
+	if err != nil {
+		t.Fatal(err)
+	}
+	original := slog.Default()
+	slog.SetDefault(logger)
+	t.Cleanup(func() { slog.SetDefault(original) })
+	return &buf
+}
+
+func TestAccessLog(t *testing.T) {
+	buf := captureLogs(t, "text")
+
+	h := Chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+		io.WriteString(w, "short and stout")
+	}), RequestID, AccessLog)
+	req := httptest.NewRequest("GET", "/search?q=queen", nil)
+	req.Header.Set(RequestIDHeader, "req-1")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	for _, want := range []string{`method=GET`, `path="/search?q=queen"`, `status=418`, `bytes=15`, `duration=`, `request_id=req-1`} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("access log %q is missing %q", buf.String(), want)
+		}
+	}
+}
+
+func TestRecover(t *testing.T) {
+	buf := captureLogs(t, "text")
+
+	panicking := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1-html"`)
+		panic("template exploded")
+	})
+	tests := []struct {
+		name     string
+		accept   string
+		wantType string
+		wantBody string
+	}{
+		{name: "Error page", accept: "text/html", wantType: "text/html; charset=utf-8", wantBody: "Request ID: <code>req-2</code>"},
+		{name: "Problem document", accept: "application/json", wantType: "application/problem+json", wantBody: `"requestId":"req-2"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/artist/1", nil)
+			req.Header.Set("Accept", tt.accept)
+			req.Header.Set(RequestIDHeader, "req-2")
+			rr := httptest.NewRecorder()
+			Chain(panicking, RequestID, Recover).ServeHTTP(rr, req)
+
+			if rr.Code != http.StatusInternalServerError || rr.Header().Get("Content-Type") != tt.wantType {
+				t.Errorf("got status %d and type %q", rr.Code, rr.Header().Get("Content-Type"))
+			}
+			if rr.Header().Get("ETag") != "" {
+				t.Error("error response kept the ETag set before the panic")
+			}
+			if !strings.Contains(rr.Body.String(), tt.wantBody) {
+				t.Errorf("body missing %q: %s", tt.wantBody, rr.Body.String())
+			}
+		})
+	}
+	if !strings.Contains(buf.String(), `panic="template exploded"`) || !strings.Contains(buf.String(), "request_id=req-2") {
+		t.Errorf("panic was not logged with its request ID: %s", buf.String())
+	}
+
+	// Once the body has started the response can only be aborted
+	defer func() {
+		if err := recover(); err != http.ErrAbortHandler {
+			t.Errorf("late panic recovered as %v, want %v", err, http.ErrAbortHandler)
+		}
+	}()
+	Recover(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "partial")
+		panic("too late")
+	})).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+}
+
+func TestRequestIDSentUpstream(t *testing.T) {
+	var got string
+	snapshotAPI(t, map[string]http.HandlerFunc{"/artists": func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Get(RequestIDHeader)
+		w.Write([]byte(snapshotFixtures["/artists"]))
+	}})
+	req := httptest.NewRequest("GET", "/dates?id=1", nil)
+	req.Header.Set(RequestIDHeader, "req-3")
+	Chain(http.HandlerFunc(DatesHandler), RequestID).ServeHTTP(httptest.NewRecorder(), req)
+	if got != "req-3" {
+		t.Errorf("upstream saw request ID %q, want %q", got, "req-3")
+	}
+}
+
+func TestNewLogger(t *testing.T) {
+	if _, err := NewLogger(io.Discard, "xml", slog.LevelInfo); err == nil {
+		t.Error("NewLogger accepted an unknown format")
+	}
+	if _, err := ParseLogLevel("loud"); err == nil {
+		t.Error("ParseLogLevel accepted an unknown level")
+	}
+	level, err := ParseLogLevel("warn")
+	if err != nil || level != slog.LevelWarn {
+		t.Fatalf("ParseLogLevel(warn) = %v, %v", level, err)
+	}
+
+	var buf bytes.Buffer
+	logger, err := NewLogger(&buf, "json", level)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.WithValue(context.Background(), requestIDKey{}, "req-4")
+	logger.InfoContext(ctx, "below the level")
+	logger.With(logUpstreamURL, "http://api/artists").WarnContext(ctx, "Artist ID not found", logArtistID, 7)
+
+	var record map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("want exactly one JSON record, got %q: %v", buf.String(), err)
+	}
+	want := map[string]any{"level": "WARN", "msg": "Artist ID not found", logRequestID: "req-4", logArtistID: 7.0, logUpstreamURL: "http://api/artists"}
+	for key, value := range want {
+		if record[key] != value {
+			t.Errorf("record[%q] = %v, want %v", key, record[key], value)
+		}
+	}
+}
+
+func TestHandlerLogAttributes(t *testing.T) {
+	buf := captureLogs(t, "json")
+	snapshotAPI(t, nil)
+	req := httptest.NewRequest("GET", "/dates?id=42", nil)
+	req.Header.Set(RequestIDHeader, "req-5")
+	Chain(http.HandlerFunc(DatesHandler), RequestID).ServeHTTP(httptest.NewRecorder(), req)
+
+	found := false
+	for _, line := range bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n")) {
+		var record map[string]any
+		if err := json.Unmarshal(line, &record); err != nil {
+			t.Fatalf("invalid JSON log line %q: %v", line, err)
+		}
+		if record["msg"] == "Artist ID not found" {
+			found = record[logArtistID] == 42.0 && record[logRequestID] == "req-5"
+		}
+		if record["msg"] == "Upstream request" && record[logUpstreamURL] == nil {
+			t.Errorf("upstream record without %s: %v", logUpstreamURL, record)
+		}
+	}
+	if !found {
+		t.Errorf("no not-found record with the artist and request IDs in:\n%s", buf.String())
+	}
+}
+
+func TestHistogramExposition(t *testing.T) {
+	h := newHistogramVec("test_seconds", "A test histogram.", "route")
+	h.observe(0.3, `/a"b`)
+	h.observe(20, `/a"b`)
+	var buf bytes.Buffer
+	h.write(&buf)
+
+	for _, want := range []string{
+		"# HELP test_seconds A test histogram.\n# TYPE test_seconds histogram\n",
+		`test_seconds_bucket{route="/a\"b",le="0.25"} 0` + "\n",
+		`test_seconds_bucket{route="/a\"b",le="0.5"} 1` + "\n",
+		`test_seconds_bucket{route="/a\"b",le="10"} 1` + "\n",
+		`test_seconds_bucket{route="/a\"b",le="+Inf"} 2` + "\n",
+		`test_seconds_sum{route="/a\"b"} 20.3` + "\n",
+		`test_seconds_count{route="/a\"b"} 2` + "\n",
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("exposition is missing %q:\n%s", want, buf.String())
+		}
+	}
+}
+
+// useMetrics gives the test a fresh metric set.
+func useMetrics(t *testing.T) {
+	t.Helper()
+	original := metrics
+	metrics = newMetricSet()
+	t.Cleanup(func() { metrics = original })
+}
+
+// counterValue returns the count c has for the label values.
+func counterValue(c *counterVec, values ...string) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.counts[c.key(values)]
+}
+
+func TestMetricsHandler(t *testing.T) {
+	useMetrics(t)
+	snapshotAPI(t, map[string]http.HandlerFunc{"/relation": func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}})
+
+	serve := func(handler http.HandlerFunc, target string) {
+		Chain(handler, Metrics).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", target, nil))
+	}
+	serve(DatesHandler, "/dates?id=abc")
+	serve(DatesHandler, "/dates?id=1")
+	snapshotAPI(t, nil)
+	serve(DatesHandler, "/dates?id=1")
+	serve(DatesHandler, "/dates?id=1")
+	serve(SearchHandler, "/search?q=queen")
+	serve(ArtistHandler, "/artist/1")
+	serve(ArtistHandler, "/no/such/page")
+
+	rr := httptest.NewRecorder()
+	MetricsHandler(rr, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rr.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	body := rr.Body.String()
+	for _, want := range []string{
+		`groupie_http_requests_total{route="/dates",status="400"} 1`,
+		`groupie_http_requests_total{route="/dates",status="502"} 1`,
+		`groupie_http_requests_total{route="/dates",status="200"} 2`,
+		`groupie_http_requests_total{route="/artist/{id}",status="200"} 1`,
+		`groupie_http_requests_total{route="other",status="400"} 1`,
+		`groupie_http_request_duration_seconds_count{route="/dates"} 4`,
+		`groupie_upstream_request_duration_seconds_count{resource="artists"}`,
+		`groupie_upstream_failures_total{resource="relation",reason="unavailable"} 1`,
+		`groupie_cache_requests_total{result="hit"} 3`,
+		`groupie_cache_requests_total{result="miss"} 2`,
+		`groupie_cache_refreshes_total{result="error"} 1`,
+		`groupie_cache_refreshes_total{result="updated"} 1`,
+		"groupie_cache_age_seconds ",
+		"groupie_search_duration_seconds_count 1",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics are missing %q:\n%s", want, body)
+		}
+	}
+}
+
+func TestHealthHandler(t *testing.T) {
+	rr := httptest.NewRecorder()
+	HealthHandler(rr, httptest.NewRequest("GET", "/healthz", nil))
+	if rr.Code != http.StatusOK || strings.TrimSpace(rr.Body.String()) != `{"status":"ok"}` {
+		t.Errorf("got %d %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestReadyHandler(t *testing.T) {
+	loaded := func(age time.Duration) DataCache {
+		return DataCache{Artists: []CachedArtist{{Artist: Artist{ID: 1, Name: "Queen"}}}, Version: "v1", LastFetched: time.Now().Add(-age)}
+	}
+	tests := []struct {
+		name         string
+		cache        DataCache
+		circuitOpen  bool
+		wantStatus   int
+		wantCache    string
+		wantUpstream string
+		wantLoaded   bool
+	}{
+		{name: "Nothing loaded", cache: DataCache{}, wantStatus: http.StatusServiceUnavailable, wantCache: checkFail, wantUpstream: checkOK},
+		{name: "Fresh data", cache: loaded(time.Minute), wantStatus: http.StatusOK, wantCache: checkOK, wantUpstream: checkOK, wantLoaded: true},
+		{name: "Data too old", cache: loaded(4 * CacheDuration), wantStatus: http.StatusServiceUnavailable, wantCache: checkFail, wantUpstream: checkOK, wantLoaded: true},
+		{name: "Circuit open with fresh data", cache: loaded(time.Minute), circuitOpen: true, wantStatus: http.StatusOK, wantCache: checkOK, wantUpstream: checkOK, wantLoaded: true},
+		{name: "Circuit open with expired data", cache: loaded(CacheDuration + time.Minute), circuitOpen: true, wantStatus: http.StatusServiceUnavailable, wantCache: checkOK, wantUpstream: checkFail, wantLoaded: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := useMockUpstream(t, "http://127.0.0.1:1")
+			if tt.circuitOpen {
+				for i := 0; i < client.Breaker.Threshold; i++ {
+					client.Breaker.Failure()
+				}
+			}
+			dataCache = tt.cache
+
+			rr := httptest.NewRecorder()
+			ReadyHandler(rr, httptest.NewRequest("GET", "/readyz", nil))
+			var report Readiness
+			if err := json.NewDecoder(rr.Body).Decode(&report); err != nil {
+				t.Fatalf("could not decode readiness: %v", err)
+			}
+			if rr.Code != tt.wantStatus || report.Cache.Status != tt.wantCache || report.Upstream.Status != tt.wantUpstream || report.Cache.Loaded != tt.wantLoaded {
+				t.Errorf("got %d %+v", rr.Code, report)
+			}
+			if wantReady := tt.wantStatus == http.StatusOK; (report.Status == "ready") != wantReady {
+				t.Errorf("status %q does not match HTTP %d", report.Status, rr.Code)
+			}
+		})
+	}
+}
+
+func TestCORS(t *testing.T) {
+	tests := []struct {
+		name        string
+		origins     []string
+		method      string
+		header      map[string]string
+		wantCode    int
+		wantOrigin  string
+		wantMethods string
+		wantHeaders string
+		wantMaxAge  string
+		reachesNext bool
+	}{
+		{name: "Same origin", origins: []string{"http://localhost:3000"}, method: "GET", wantCode: http.StatusOK, reachesNext: true},
+		{name: "Allowed origin", origins: []string{"http://localhost:3000"}, method: "GET", header: map[string]string{"Origin": "http://localhost:3000"}, wantCode: http.StatusOK, wantOrigin: "http://localhost:3000", reachesNext: true},
+		{name: "Other origin", origins: []string{"http://localhost:3000"}, method: "GET", header: map[string]string{"Origin": "http://evil.example"}, wantCode: http.StatusOK, reachesNext: true},
+		{name: "Any origin", origins: []string{"*"}, method: "GET", header: map[string]string{"Origin": "http://evil.example"}, wantCode: http.StatusOK, wantOrigin: "*", reachesNext: true},
+		{name: "No origins configured", method: "GET", header: map[string]string{"Origin": "http://localhost:3000"}, wantCode: http.StatusOK, reachesNext: true},
+		{
+			name: "Preflight", origins: []string{"http://localhost:3000"}, method: "OPTIONS",
+			header:   map[string]string{"Origin": "http://localhost:3000", "Access-Control-Request-Method": "GET", "Access-Control-Request-Headers": "X-Request-ID, If-None-Match"},
+			wantCode: http.StatusNoContent, wantOrigin: "http://localhost:3000", wantMethods: "GET, HEAD", wantHeaders: "X-Request-ID, If-None-Match", wantMaxAge: "600",
+		},
+		{
+			name: "Preflight from other origin", origins: []string{"http://localhost:3000"}, method: "OPTIONS",
+			header:   map[string]string{"Origin": "http://evil.example", "Access-Control-Request-Method": "GET"},
+			wantCode: http.StatusNoContent,
+		},
+		{
+			name: "Preflight for POST", origins: []string{"http://localhost:3000"}, method: "OPTIONS",
+			header:   map[string]string{"Origin": "http://localhost:3000", "Access-Control-Request-Method": "POST"},
+			wantCode: http.StatusNoContent,
+		},
+		{
+			name: "Preflight with unknown header", origins: []string{"http://localhost:3000"}, method: "OPTIONS",
+			header:   map[string]string{"Origin": "http://localhost:3000", "Access-Control-Request-Method": "GET", "Access-Control-Request-Headers": "Authorization"},
+			wantCode: http.StatusNoContent,
+		},
+		{name: "Plain OPTIONS", origins: []string{"http://localhost:3000"}, method: "OPTIONS", header: map[string]string{"Origin": "http://localhost:3000"}, wantCode: http.StatusOK, wantOrigin: "http://localhost:3000", reachesNext: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reached := false
+			h := CORS(CORSOptions{AllowedOrigins: tt.origins, MaxAge: 10 * time.Minute})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				reached = true
+			}))
+			req := httptest.NewRequest(tt.method, "/dates?id=1", nil)
+			for k, v := range tt.header {
+				req.Header.Set(k, v)
+			}
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, req)
+
+			if rr.Code != tt.wantCode || reached != tt.reachesNext {
+				t.Errorf("got status %d, handler reached %t; want %d, %t", rr.Code, reached, tt.wantCode, tt.reachesNext)
+			}
+			got := rr.Header()
+			if got.Get("Access-Control-Allow-Origin") != tt.wantOrigin {
+				t.Errorf("Access-Control-Allow-Origin = %q, want %q", got.Get("Access-Control-Allow-Origin"), tt.wantOrigin)
+			}
+			if got.Get("Access-Control-Allow-Methods") != tt.wantMethods || got.Get("Access-Control-Allow-Headers") != tt.wantHeaders || got.Get("Access-Control-Max-Age") != tt.wantMaxAge {
+				t.Errorf("preflight headers = %q, %q, %q; want %q, %q, %q",
+					got.Get("Access-Control-Allow-Methods"), got.Get("Access-Control-Allow-Headers"), got.Get("Access-Control-Max-Age"),
+					tt.wantMethods, tt.wantHeaders, tt.wantMaxAge)
+			}
+			if !slices.Contains(got.Values("Vary"), "Origin") {
+				t.Errorf("Vary = %q, want it to include Origin", got.Values("Vary"))
+			}
+			if exposed := got.Get("Access-Control-Expose-Headers"); tt.reachesNext && (exposed != "") != (tt.wantOrigin != "") {
+				t.Errorf("Access-Control-Expose-Headers = %q with allowed origin %q", exposed, tt.wantOrigin)
+			}
+		})
+	}
+}
+
+// TestHandlerMethods checks that every route accepts the methods a CORS
+// preflight approves, and only those.
+func TestHandlerMethods(t *testing.T) {
+	snapshotAPI(t, nil)
+	tests := []struct {
+		handler http.HandlerFunc
+		target  string
+	}{
+		{IndexHandler, "/"},
+		{ArtistHandler, "/artist/1"},
+		{DatesHandler, "/dates?id=1"},
+		{LocationsHandler, "/locations?id=1"},
+		{RelationHandler, "/relations?id=1"},
+		{SearchHandler, "/search?q=qu"},
+		{FilteredArtistsHandler, "/getArtists?q=qu"},
+		{BatchArtistsHandler, "/api/v1/artists?ids=1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			tt.handler(rr, httptest.NewRequest("HEAD", tt.target, nil))
+			if rr.Code != http.StatusOK {
+				t.Errorf("HEAD got status %d, want 200", rr.Code)
+			}
+			rr = httptest.NewRecorder()
+			tt.handler(rr, httptest.NewRequest("POST", tt.target, nil))
+			if rr.Code != http.StatusMethodNotAllowed || rr.Header().Get("Allow") != corsAllowedMethods {
+				t.Errorf("POST got status %d with Allow %q, want 405 with %q", rr.Code, rr.Header().Get("Allow"), corsAllowedMethods)
+			}
+		})
+	}
+}
+
+func TestSecurityHeaders(t *testing.T) {
+	policy := "script-src 'nonce-" + NoncePlaceholder + "'; style-src 'nonce-" + NoncePlaceholder + "'"
+	tests := []struct {
+		name       string
+		opts       SecurityOptions
+		wantHeader string
+		wantHSTS   string
+	}{
+		{name: "Enforced", opts: SecurityOptions{CSP: policy}, wantHeader: "Content-Security-Policy"},
+		{name: "Report only", opts: SecurityOptions{CSP: policy, CSPReportOnly: true}, wantHeader: "Content-Security-Policy-Report-Only"},
+		{name: "No policy", opts: SecurityOptions{}},
+		{name: "HSTS", opts: SecurityOptions{CSP: policy, HSTSMaxAge: 24 * time.Hour}, wantHeader: "Content-Security-Policy", wantHSTS: "max-age=86400"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var nonces []string
+			h := SecurityHeaders(tt.opts)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				nonces = append(nonces, CSPNonce(r.Context()))
+			}))
+			var policies []string
+			for range 2 {
+				rr := httptest.NewRecorder()
+				h.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+				got := rr.Header()
+				if got.Get("X-Content-Type-Options") != "nosniff" || got.Get("X-Frame-Options") != "DENY" || got.Get("Referrer-Policy") == "" {
+					t.Errorf("missing security headers: %v", got)
+				}
+				if got.Get("Strict-Transport-Security") != tt.wantHSTS {
+					t.Errorf("Strict-Transport-Security = %q, want %q", got.Get("Strict-Transport-Security"), tt.wantHSTS)
+				}
+				if tt.wantHeader != "" {
+					policies = append(policies, got.Get(tt.wantHeader))
+				} else if got.Get("Content-Security-Policy") != "" || got.Get("Content-Security-Policy-Report-Only") != "" {
+					t.Errorf("sent a policy although none is configured: %v", got)
+				}
+			}
+
+			if tt.wantHeader == "" {
+				if nonces[0] != "" {
+					t.Errorf("nonce %q generated without a policy", nonces[0])
+				}
+				return
+			}
+			if nonces[0] == "" || nonces[0] == nonces[1] {
+				t.Errorf("nonces %q are not unique per request", nonces)
+			}
+			for i, p := range policies {
+				if want := strings.ReplaceAll(policy, NoncePlaceholder, nonces[i]); p != want {
+					t.Errorf("policy = %q, want %q", p, want)
+				}
+			}
+		})
+	}
+}
+
+func TestPagesCarryNonce(t *testing.T) {
+	snapshotAPI(t, nil)
+	h := SecurityHeaders(SecurityOptions{CSP: "script-src 'nonce-" + NoncePlaceholder + "'"})
+	serve := func(handler http.HandlerFunc, target string, header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", target, nil)
+		req.Header = header
+		rr := httptest.NewRecorder()
+		h(handler).ServeHTTP(rr, req)
+		return rr
+	}
+
+	for _, tt := range []struct {
+		name    string
+		handler http.HandlerFunc
+		target  string
+		tags    []string
+	}{
+		{name: "Index", handler: IndexHandler, target: "/", tags: []string{"<script"}},
+		{name: "Error page", handler: ArtistHandler, target: "/artist/999", tags: []string{"<style"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := serve(tt.handler, tt.target, http.Header{"Accept": {"text/html"}})
+			nonce := strings.TrimSuffix(strings.TrimPrefix(rr.Header().Get("Content-Security-Policy"), "script-src 'nonce-"), "'")
+			body := rr.Body.String()
+			for _, tag := range tt.tags {
+				if n := strings.Count(body, tag); n == 0 || n != strings.Count(body, tag+` nonce="`+nonce+`"`) {
+					t.Errorf("not every %s tag carries the nonce %q", tag, nonce)
+				}
+			}
+			if strings.Contains(body, ` style="`) {
+				t.Error("page has inline style attributes")
+			}
+		})
+	}
+
+	// Pages differing only by their nonce get the same weak ETag, which a
+	// shared cache must not store
+	first := serve(IndexHandler, "/", http.Header{"Accept": {"text/html"}})
+	second := serve(IndexHandler, "/", http.Header{"Accept": {"text/html"}})
+	if etag := first.Header().Get("ETag"); !strings.HasPrefix(etag, "W/") || etag != second.Header().Get("ETag") {
+		t.Errorf("page ETags = %q and %q, want the same weak one", etag, second.Header().Get("ETag"))
+	}
+	if cc := first.Header().Get("Cache-Control"); !strings.Contains(cc, "private") {
+		t.Errorf("page Cache-Control = %q, want it private", cc)
+	}
+
+	// A 304 must leave the stored policy, whose nonce matches the stored page
+	rr := serve(IndexHandler, "/", http.Header{"Accept": {"text/html"}, "If-None-Match": {first.Header().Get("ETag")}})
+	if rr.Code != http.StatusNotModified || rr.Header().Get("Content-Security-Policy") != "" {
+		t.Errorf("revalidation got %d with policy %q, want 304 without one", rr.Code, rr.Header().Get("Content-Security-Policy"))
+	}
+}
+
+func TestParamValidation(t *testing.T) {
+	long := strings.Repeat("é", maxQueryLength+1)
+	tests := []struct {
+		name       string
+		handler    http.HandlerFunc
+		target     string
+		wantDetail string
+		wantErrors []FieldError
+	}{
+		{name: "Missing ID", handler: DatesHandler, target: "/dates", wantDetail: "Missing artist ID", wantErrors: []FieldError{{"id", "is required"}}},
+		{name: "Empty ID", handler: LocationsHandler, target: "/locations?id=", wantDetail: "Missing artist ID", wantErrors: []FieldError{{"id", "is required"}}},
+		{name: "Non-integer ID", handler: RelationHandler, target: "/relations?id=1.5", wantDetail: "Invalid artist ID", wantErrors: []FieldError{{"id", "must be an integer"}}},
+		{name: "Zero ID", handler: DatesHandler, target: "/dates?id=0", wantDetail: "Invalid artist ID", wantErrors: []FieldError{{"id", "must be between 1 and 1000000"}}},
+		{name: "Negative ID", handler: LocationsHandler, target: "/locations?id=-3", wantDetail: "Invalid artist ID", wantErrors: []FieldError{{"id", "must be between 1 and 1000000"}}},
+		{name: "Huge ID", handler: RelationHandler, target: "/relations?id=99999999999999999999", wantDetail: "Invalid artist ID", wantErrors: []FieldError{{"id", "must be an integer"}}},
+		{name: "Repeated ID", handler: DatesHandler, target: "/dates?id=1&id=2", wantDetail: "Invalid id parameter", wantErrors: []FieldError{{"id", "must be given only once"}}},
+		{name: "Artist path ID out of range", handler: ArtistHandler, target: "/artist/1000001", wantDetail: "Invalid artist ID", wantErrors: []FieldError{{"id", "must be between 1 and 1000000"}}},
+		{name: "Artist path ID not an integer", handler: ArtistHandler, target: "/artist/1/extra", wantDetail: "Invalid artist ID", wantErrors: []FieldError{{"id", "must be an integer"}}},
+		{name: "Missing query", handler: SearchHandler, target: "/search", wantDetail: "Search query is required", wantErrors: []FieldError{{"q", "is required"}}},
+		{name: "Blank query", handler: FilteredArtistsHandler, target: "/getArtists?q=%20%20", wantDetail: "Search query is required", wantErrors: []FieldError{{"q", "is required"}}},
+		{name: "Long query", handler: SearchHandler, target: "/search?q=" + url.QueryEscape(long), wantDetail: "Search query is too long", wantErrors: []FieldError{{"q", "must be at most 100 characters"}}},
+		{name: "Control characters", handler: FilteredArtistsHandler, target: "/getArtists?q=a%00b", wantDetail: "Invalid search query", wantErrors: []FieldError{{"q", "must not contain control characters"}}},
+		{name: "Invalid UTF-8", handler: SearchHandler, target: "/search?q=%ff", wantDetail: "Invalid search query", wantErrors: []FieldError{{"q", "must be valid UTF-8"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Parameters are checked before the cache is read, so no upstream is needed
+			req := httptest.NewRequest("GET", tt.target, nil)
+			req.Header.Set("Accept", "application/json")
+			rr := httptest.NewRecorder()
+			tt.handler(rr, req)
+
+			var problem Problem
+			if err := json.NewDecoder(rr.Body).Decode(&problem); err != nil {
+				t.Fatalf("could not decode problem: %v", err)
+			}
+			if rr.Code != http.StatusBadRequest || problem.Type != ProblemTypeValidation || problem.Detail != tt.wantDetail {
+				t.Errorf("got %d %s %q, want 400 %s %q", rr.Code, problem.Type, problem.Detail, ProblemTypeValidation, tt.wantDetail)
+			}
+			if !reflect.DeepEqual(problem.Errors, tt.wantErrors) {
+				t.Errorf("errors = %+v, want %+v", problem.Errors, tt.wantErrors)
+			}
+		})
+	}
+}
+
+func TestQueryParams(t *testing.T) {
+	fields := []string{"name", "members", "locations"}
+	tests := []struct {
+		name       string
+		query      string
+		wantFields []string
+		wantErrors []FieldError
+	}{
+		{name: "Defaults", query: ""},
+		{name: "Valid", query: "fields=name,members,name", wantFields: []string{"name", "members"}},
+		{name: "Unknown list item", query: "fields=name,age", wantErrors: []FieldError{{"fields", `"age" is not one of name, members, locations`}}},
+		{name: "Empty list item", query: "fields=name,,members", wantErrors: []FieldError{{"fields", "must not contain empty items"}}},
+		{name: "Too many items", query: "fields=name,members,locations,name", wantErrors: []FieldError{{"fields", "must have at most 3 items"}}},
+		{name: "Given twice", query: "fields=name&fields=members", wantErrors: []FieldError{{"fields", "must be given only once"}}},
+		{
+			name: "Every error reported", query: "fields=age&include=dates,",
+			wantErrors: []FieldError{{"fields", `"age" is not one of name, members, locations`}, {"include", "must not contain empty items"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newQueryParams(httptest.NewRequest("GET", "/?"+tt.query, nil))
+			got := p.list("fields", 3, fields...)
+			p.list("include", 3)
+			if !reflect.DeepEqual(got, tt.wantFields) {
+				t.Errorf("got %q, want %q", got, tt.wantFields)
+			}
+			problem := p.problem()
+			if tt.wantErrors == nil {
+				if problem != nil {
+					t.Errorf("unexpected problem %+v", problem)
+				}
+				return
+			}
+			if problem == nil || !reflect.DeepEqual(problem.Errors, tt.wantErrors) {
+				t.Fatalf("problem = %+v, want errors %+v", problem, tt.wantErrors)
+			}
+			if len(tt.wantErrors) > 1 && problem.Detail != "2 request parameters are invalid" {
+				t.Errorf("detail = %q", problem.Detail)
+			}
+		})
+	}
+}
+
+func TestBatchArtistsHandler(t *testing.T) {
+	snapshotAPI(t, map[string]http.HandlerFunc{"/artists": func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[{"id": 1, "name": "Queen", "members": ["Freddie Mercury"]}, {"id": 2, "name": "SOJA"}]`))
+	}})
+
+	tests := []struct {
+		name         string
+		target       string
+		wantStatus   int
+		wantBody     string
+		wantProblem  string
+		wantErrField string
+	}{
+		{
+			name:       "Without includes",
+			target:     "/api/v1/artists?ids=2,1",
+			wantStatus: http.StatusOK,
+			wantBody: `{"artists":[{"creationDate":0,"firstAlbum":"","id":2,"image":"","members":[],"name":"SOJA"},` +
+				`{"creationDate":0,"firstAlbum":"","id":1,"image":"","members":["Freddie Mercury"],"name":"Queen"}],"notFound":[]}`,
+		},
+		{
+			name:       "With includes",
+			target:     "/api/v1/artists?ids=1&include=relations,locations,dates",
+			wantStatus: http.StatusOK,
+			wantBody: `{"artists":[{"creationDate":0,"dates":["2023-09-12"],"firstAlbum":"","id":1,"image":"","locations":["london-uk"],` +
+				`"members":["Freddie Mercury"],"name":"Queen","relations":{"london-uk":["2023-09-12"]}}],"notFound":[]}`,
+		},
+		{
+			name:       "Included but empty",
+			target:     "/api/v1/artists?ids=2&include=dates,relations",
+			wantStatus: http.StatusOK,
+			wantBody:   `{"artists":[{"creationDate":0,"dates":[],"firstAlbum":"","id":2,"image":"","members":[],"name":"SOJA","relations":{}}],"notFound":[]}`,
+		},
+		{
+			name:       "Unknown and repeated IDs",
+			target:     "/api/v1/artists?ids=7,1,01,9",
+			wantStatus: http.StatusOK,
+			wantBody:   `{"artists":[{"creationDate":0,"firstAlbum":"","id":1,"image":"","members":["Freddie Mercury"],"name":"Queen"}],"notFound":[7,9]}`,
+		},
+		{name: "Missing IDs", target: "/api/v1/artists?include=dates", wantStatus: http.StatusBadRequest, wantProblem: "Missing artist IDs", wantErrField: "ids"},
+		{name: "Invalid ID", target: "/api/v1/artists?ids=1,abc", wantStatus: http.StatusBadRequest, wantProblem: "Invalid artist ID", wantErrField: "ids"},
+		{name: "Too many IDs", target: "/api/v1/artists?ids=" + strings.Repeat("1,", maxBatchIDs) + "999", wantStatus: http.StatusBadRequest, wantProblem: "Invalid ids parameter", wantErrField: "ids"},
+		{name: "Unknown include", target: "/api/v1/artists?ids=1&include=albums", wantStatus: http.StatusBadRequest, wantProblem: "Invalid include parameter", wantErrField: "include"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			BatchArtistsHandler(rr, httptest.NewRequest("GET", tt.target, nil))
+			if rr.Code != tt.wantStatus {
+				t.Fatalf("got status %d, want %d: %s", rr.Code, tt.wantStatus, rr.Body)
+			}
+			if tt.wantStatus == http.StatusOK {
+				if got := strings.TrimSpace(rr.Body.String()); got != tt.wantBody {
+					t.Errorf("body = %s\nwant %s", got, tt.wantBody)
+				}
+				return
+			}
+			var problem Problem
+			if err := json.NewDecoder(rr.Body).Decode(&problem); err != nil {
+				t.Fatal(err)
+			}
+			if problem.Detail != tt.wantProblem || len(problem.Errors) != 1 || problem.Errors[0].Field != tt.wantErrField {
+				t.Errorf("problem = %+v, want %q on %s", problem, tt.wantProblem, tt.wantErrField)
+			}
+		})
+	}
+
+	rr := httptest.NewRecorder()
+	BatchArtistsHandler(rr, httptest.NewRequest("POST", "/api/v1/artists?ids=1", nil))
+	if rr.Code != http.StatusMethodNotAllowed || rr.Header().Get("Allow") != "GET, HEAD" {
+		t.Errorf("POST got %d with Allow %q", rr.Code, rr.Header().Get("Allow"))
+	}
+}
+
+func TestArtistFieldsAndIncludes(t *testing.T) {
+	snapshotAPI(t, nil)
+	tests := []struct {
+		name       string
+		handler    http.HandlerFunc
+		target     string
+		accept     string
+		wantStatus int
+		wantBody   string
+	}{
+		{name: "Index fields", handler: IndexHandler, target: "/?fields=name", accept: "application/json", wantStatus: http.StatusOK, wantBody: `[{"id":1,"name":"Queen"}]`},
+		{name: "Index include", handler: IndexHandler, target: "/?fields=id&include=locations", accept: "application/json", wantStatus: http.StatusOK, wantBody: `[{"id":1,"locations":["london-uk"]}]`},
+		{name: "Artist fields", handler: ArtistHandler, target: "/artist/1?fields=name,members&include=dates", accept: "application/json", wantStatus: http.StatusOK, wantBody: `{"dates":["2023-09-12"],"id":1,"members":[],"name":"Queen"}`},
+		{name: "Artist include only", handler: ArtistHandler, target: "/artist/1?include=relations", accept: "application/json", wantStatus: http.StatusOK, wantBody: `{"creationDate":0,"firstAlbum":"","id":1,"image":"","members":[],"name":"Queen","relations":{"london-uk":["2023-09-12"]}}`},
+		{name: "Search fields", handler: FilteredArtistsHandler, target: "/getArtists?q=que&fields=name", wantStatus: http.StatusOK, wantBody: `[{"id":1,"name":"Queen"}]`},
+		{name: "Search without matches", handler: FilteredArtistsHandler, target: "/getArtists?q=zzz&fields=name", wantStatus: http.StatusOK, wantBody: `[]`},
+		{name: "Batch fields", handler: BatchArtistsHandler, target: "/api/v1/artists?ids=1&fields=firstAlbum", wantStatus: http.StatusOK, wantBody: `{"artists":[{"firstAlbum":"","id":1}],"notFound":[]}`},
+		{name: "Unknown field", handler: FilteredArtistsHandler, target: "/getArtists?q=que&fields=name,age", wantStatus: http.StatusBadRequest},
+		{name: "Unknown include", handler: ArtistHandler, target: "/artist/1?include=albums", accept: "application/json", wantStatus: http.StatusBadRequest},
+		{name: "Upstream links are not a field", handler: IndexHandler, target: "/?fields=locations", accept: "application/json", wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tt.target, nil)
+			if tt.accept != "" {
+				req.Header.Set("Accept", tt.accept)
+			}
+			rr := httptest.NewRecorder()
+			tt.handler(rr, req)
+			if rr.Code != tt.wantStatus {
+				t.Fatalf("got status %d, want %d: %s", rr.Code, tt.wantStatus, rr.Body)
+			}
+			if tt.wantBody != "" {
+				if got := strings.TrimSpace(rr.Body.String()); got != tt.wantBody {
+					t.Errorf("body = %s\nwant %s", got, tt.wantBody)
+				}
+			}
+		})
+	}
+
+	// Without the parameters the original responses are unchanged
+	rr := httptest.NewRecorder()
+	FilteredArtistsHandler(rr, httptest.NewRequest("GET", "/getArtists?q=que", nil))
+	var full []CachedArtist
+	if err := json.NewDecoder(rr.Body).Decode(&full); err != nil || len(full) != 1 || full[0].Artist.Name != "Queen" || len(full[0].Locations) != 1 {
+		t.Errorf("full response = %+v, %v", full, err)
+	}
+
+	// Pages ignore them
+	req := httptest.NewRequest("GET", "/artist/1?fields=bogus", nil)
+	req.Header.Set("Accept", "text/html")
+	rr = httptest.NewRecorder()
+	ArtistHandler(rr, req)
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Header().Get("Content-Type"), "text/html") {
+		t.Errorf("artist page got %d %s", rr.Code, rr.Header().Get("Content-Type"))
+	}
+}
@@ -0,0 +1,295 @@
+package groupie
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultBuckets are the upper bounds, in seconds, of the latency histograms.
+var defaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// metricSet holds every metric served on /metrics.
+type metricSet struct {
+	requests        *counterVec
+	requestDuration *histogramVec
+	upstreamLatency *histogramVec
+	upstreamErrors  *counterVec
+	cacheLookups    *counterVec
+	cacheRefreshes  *counterVec
+	searchDuration  *histogramVec
+}
+
+func newMetricSet() *metricSet {
+	return &metricSet{
+		requests:        newCounterVec("groupie_http_requests_total", "HTTP requests served, by route and status code.", "route", "status"),
+		requestDuration: newHistogramVec("groupie_http_request_duration_seconds", "Time taken to serve HTTP requests, by route.", "route"),
+		upstreamLatency: newHistogramVec("groupie_upstream_request_duration_seconds", "Duration of upstream API calls including retries, by resource.", "resource"),
+		upstreamErrors:  newCounterVec("groupie_upstream_failures_total", "Failed upstream API calls, by resource and reason.", "resource", "reason"),
+		cacheLookups:    newCounterVec("groupie_cache_requests_total", "Reads of the artist data cache, by whether it was fresh (hit) or had to be refreshed (miss).", "result"),
+		cacheRefreshes:  newCounterVec("groupie_cache_refreshes_total", "Refreshes of the artist data cache, by outcome.", "result"),
+		searchDuration:  newHistogramVec("groupie_search_duration_seconds", "Time taken to answer search queries."),
+	}
+}
+
+var metrics = newMetricSet()
+
+// Metrics counts requests and their latency by route and status code.
+func Metrics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &responseRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		route := routeLabel(r.URL.Path)
+		metrics.requests.inc(route, strconv.Itoa(rec.Status()))
+		metrics.requestDuration.observe(time.Since(start).Seconds(), route)
+	})
+}
+
+// knownRoutes are the paths labelled as they are; anything else would let
+// clients create a time series per URL.
+var knownRoutes = map[string]bool{
+	"/": true, "/locations": true, "/dates": true, "/relations": true,
+	"/search": true, "/getArtists": true, "/metrics": true, "/healthz": true, "/readyz": true,
+	"/api/v1/artists": true,
+}
+
+func routeLabel(path string) string {
+	switch {
+	case knownRoutes[path]:
+		return path
+	case strings.HasPrefix(path, "/artist/"):
+		return "/artist/{id}"
+	case strings.HasPrefix(path, "/static/"):
+		return "/static/"
+	default:
+		return "other"
+	}
+}
+
+// observeUpstream records the duration and outcome of a call to rawURL.
+func observeUpstream(rawURL string, d time.Duration, err error) {
+	resource := upstreamResource(rawURL)
+	// Calls the breaker turned away never reached the API
+	if !errors.Is(err, ErrCircuitOpen) {
+		metrics.upstreamLatency.observe(d.Seconds(), resource)
+	}
+	switch {
+	case err == nil, errors.Is(err, context.Canceled):
+	case errors.Is(err, ErrCircuitOpen):
+		metrics.upstreamErrors.inc(resource, "circuit_open")
+	case errors.Is(err, ErrUpstreamTimeout):
+		metrics.upstreamErrors.inc(resource, "timeout")
+	case errors.Is(err, ErrUpstreamMalformed):
+		metrics.upstreamErrors.inc(resource, "malformed")
+	default:
+		metrics.upstreamErrors.inc(resource, "unavailable")
+	}
+}
+
+// upstreamResource names the API resource of rawURL: the first path segment
+// after the base URL, so /locations/3 counts as locations.
+func upstreamResource(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "other"
+	}
+	path := u.Path
+	if base, err := url.Parse(upstream.BaseURL); err == nil && u.Host == base.Host {
+		path = strings.TrimPrefix(path, base.Path)
+	}
+	resource, _, _ := strings.Cut(strings.TrimPrefix(path, "/"), "/")
+	switch resource {
+	case ResourceArtists, ResourceLocations, ResourceDates, ResourceRelations:
+		return resource
+	}
+	return "other"
+}
+
+// MetricsHandler serves the metrics in the Prometheus text exposition format.
+func MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		methodNotAllowedJSON(w, r, "GET, HEAD")
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	bw := bufio.NewWriter(w)
+	metrics.requests.write(bw)
+	metrics.requestDuration.write(bw)
+	metrics.upstreamLatency.write(bw)
+	metrics.upstreamErrors.write(bw)
+	metrics.cacheLookups.write(bw)
+	metrics.cacheRefreshes.write(bw)
+	writeCacheAge(bw)
+	metrics.searchDuration.write(bw)
+	bw.Flush()
+}
+
+// writeCacheAge reports how long ago the cached data was last fetched. It is
+// left out until the cache has been loaded.
+func writeCacheAge(w io.Writer) {
+	cacheMu.RLock()
+	lastFetched := dataCache.LastFetched
+	cacheMu.RUnlock()
+	fmt.Fprintln(w, "# HELP groupie_cache_age_seconds Time since the artist data cache was last fetched from upstream.")
+	fmt.Fprintln(w, "# TYPE groupie_cache_age_seconds gauge")
+	if !lastFetched.IsZero() {
+		fmt.Fprintf(w, "groupie_cache_age_seconds %s\n", formatValue(time.Since(lastFetched).Seconds()))
+	}
+}
+
+// labelled keeps the label values of each series, keyed by their join.
+type labelled struct {
+	name   string
+	help   string
+	labels []string
+	mu     sync.Mutex
+	values map[string][]string
+}
+
+func (l *labelled) key(values []string) string {
+	if len(values) != len(l.labels) {
+		panic(fmt.Sprintf("%s: got %d label values, want %d", l.name, len(values), len(l.labels)))
+	}
+	k := strings.Join(values, "\xff")
+	if _, ok := l.values[k]; !ok {
+		l.values[k] = append([]string(nil), values...)
+	}
+	return k
+}
+
+// sortedKeys returns the series keys in a stable order. l.mu must be held.
+func (l *labelled) sortedKeys() []string {
+	keys := make([]string, 0, len(l.values))
+	for k := range l.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// labelString formats label values as {name="value",...}, with extra pairs
+// appended.
+func (l *labelled) labelString(values []string, extra ...string) string {
+	var pairs []string
+	for i, name := range l.labels {
+		pairs = append(pairs, name+`="`+escapeLabel(values[i])+`"`)
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+`="`+escapeLabel(extra[i+1])+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func (l *labelled) header(w io.Writer, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", l.name, l.help, l.name, typ)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(v string) string {
+	return labelEscaper.Replace(v)
+}
+
+func formatValue(v float64) string {
+	if math.IsInf(v, +1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// counterVec is a counter per combination of label values.
+type counterVec struct {
+	labelled
+	counts map[string]float64
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{
+		labelled: labelled{name: name, help: help, labels: labels, values: make(map[string][]string)},
+		counts:   make(map[string]float64),
+	}
+}
+
+func (c *counterVec) inc(values ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.counts[c.key(values)]++
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.header(w, "counter")
+	for _, k := range c.sortedKeys() {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, c.labelString(c.values[k]), formatValue(c.counts[k]))
+	}
+}
+
+// histogramVec is a latency histogram per combination of label values.
+type histogramVec struct {
+	labelled
+	buckets []float64
+	series  map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+func newHistogramVec(name, help string, labels ...string) *histogramVec {
+	return &histogramVec{
+		labelled: labelled{name: name, help: help, labels: labels, values: make(map[string][]string)},
+		buckets:  defaultBuckets,
+		series:   make(map[string]*histogram),
+	}
+}
+
+func (h *histogramVec) observe(v float64, values ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	k := h.key(values)
+	s, ok := h.series[k]
+	if !ok {
+		s = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.series[k] = s
+	}
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+		s.counts[i]++
+	}
+	s.sum += v
+	s.count++
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.header(w, "histogram")
+	for _, k := range h.sortedKeys() {
+		s, values := h.series[k], h.values[k]
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelString(values, "le", formatValue(bound)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelString(values, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, h.labelString(values), formatValue(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, h.labelString(values), s.count)
+	}
+}
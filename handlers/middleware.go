@@ -0,0 +1,159 @@
+package groupie
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+	"time"
+)
+
+// Middleware wraps a handler with behaviour shared by every route.
+type Middleware func(http.Handler) http.Handler
+
+// Chain wraps h with the middleware, the first one outermost.
+func Chain(h http.Handler, middleware ...Middleware) http.Handler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		h = middleware[i](h)
+	}
+	return h
+}
+
+// RequestIDHeader carries the request ID to and from clients and upstream.
+const RequestIDHeader = "X-Request-ID"
+
+type requestIDKey struct{}
+
+// RequestIDFrom returns the ID RequestID gave the request ctx belongs to.
+func RequestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// RequestID gives each request an ID, reusing a well-formed one sent by the
+// client or a proxy, and echoes it in the response headers.
+func RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(RequestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// validRequestID accepts up to 64 letters, digits, '-', '_' and '.', so a
+// client cannot inject anything into the logs.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_', c == '.':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// AccessLog logs each request once it has been served, with its status, the
+// bytes written and how long it took.
+func AccessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &responseRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		slog.LogAttrs(r.Context(), slog.LevelInfo, "Request served",
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.RequestURI()),
+			slog.Int("status", rec.Status()),
+			slog.Int("bytes", rec.bytes),
+			slog.Duration(logDuration, time.Since(start)),
+		)
+	})
+}
+
+// Recover turns a panic in a handler into a 500 error page, logging the stack
+// with the request ID, instead of dropping the connection.
+func Recover(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &responseRecorder{ResponseWriter: w}
+		defer func() {
+			err := recover()
+			if err == nil {
+				return
+			}
+			// net/http uses this panic to abort a response on purpose
+			if e, ok := err.(error); ok && errors.Is(e, http.ErrAbortHandler) {
+				panic(err)
+			}
+			slog.ErrorContext(r.Context(), "Panic serving request", "method", r.Method, "path", r.URL.Path, "panic", err, "stack", string(debug.Stack()))
+			if rec.wroteHeader {
+				// Too late for an error page; cut the response short
+				panic(http.ErrAbortHandler)
+			}
+			// Validators set before the panic belong to the response that never came
+			clearValidators(w.Header())
+			WriteProblem(w, r, NewProblem(http.StatusInternalServerError, "Something went wrong on our side"))
+		}()
+		next.ServeHTTP(rec, r)
+	})
+}
+
+// responseRecorder notes the status code and body size of a response.
+type responseRecorder struct {
+	http.ResponseWriter
+	status      int
+	bytes       int
+	wroteHeader bool
+}
+
+func (rec *responseRecorder) WriteHeader(code int) {
+	if !rec.wroteHeader {
+		rec.status = code
+		rec.wroteHeader = code >= http.StatusOK || code == http.StatusSwitchingProtocols
+	}
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+func (rec *responseRecorder) Write(p []byte) (int, error) {
+	if !rec.wroteHeader {
+		rec.WriteHeader(http.StatusOK)
+	}
+	n, err := rec.ResponseWriter.Write(p)
+	rec.bytes += n
+	return n, err
+}
+
+// Status returns the status code sent, 200 if the handler wrote nothing.
+func (rec *responseRecorder) Status() int {
+	if rec.status == 0 {
+		return http.StatusOK
+	}
+	return rec.status
+}
+
+// Flush passes flushes through to the underlying writer.
+func (rec *responseRecorder) Flush() {
+	if !rec.wroteHeader {
+		rec.WriteHeader(http.StatusOK)
+	}
+	http.NewResponseController(rec.ResponseWriter).Flush()
+}
+
+// Unwrap gives http.ResponseController access to the underlying writer.
+func (rec *responseRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
@@ -0,0 +1,63 @@
+package groupie
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// acceptQuality returns the q value the Accept header gives to mediaType,
+// taken from the most specific media range that matches it.
+func acceptQuality(accept, mediaType string) float64 {
+	typ, _, _ := strings.Cut(mediaType, "/")
+	best, bestSpecificity := 0.0, -1
+	for _, part := range strings.Split(accept, ",") {
+		fields := strings.Split(part, ";")
+		mediaRange := strings.ToLower(strings.TrimSpace(fields[0]))
+
+		specificity := -1
+		switch mediaRange {
+		case mediaType:
+			specificity = 2
+		case typ + "/*":
+			specificity = 1
+		case "*/*":
+			specificity = 0
+		}
+		if specificity <= bestSpecificity {
+			continue
+		}
+
+		q := 1.0
+		for _, param := range fields[1:] {
+			name, value, ok := strings.Cut(strings.TrimSpace(param), "=")
+			if ok && strings.EqualFold(name, "q") {
+				if v, err := strconv.ParseFloat(value, 64); err == nil {
+					q = v
+				}
+			}
+		}
+		best, bestSpecificity = q, specificity
+	}
+	return best
+}
+
+// prefersJSON reports whether the client ranks JSON above HTML in its Accept
+// header. Browsers, and clients sending no preference, get HTML.
+func prefersJSON(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return false
+	}
+	jsonQ := max(acceptQuality(accept, "application/json"), acceptQuality(accept, "application/problem+json"))
+	htmlQ := acceptQuality(accept, "text/html")
+	return jsonQ > htmlQ
+}
+
+// writeJSON encodes v as the response body with the given status code.
+func writeJSON(w http.ResponseWriter, code int, contentType string, v any) error {
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(code)
+	return json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,169 @@
+package groupie
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Limits on request parameters.
+const (
+	maxArtistID    = 1_000_000
+	maxQueryLength = 100
+)
+
+// queryParams reads the parameters of a request, collecting an error for
+// every one that is missing or invalid so they can all be reported at once.
+type queryParams struct {
+	values  url.Values
+	errs    []FieldError
+	details []string
+}
+
+func newQueryParams(r *http.Request) *queryParams {
+	return &queryParams{values: r.URL.Query()}
+}
+
+func (p *queryParams) fail(detail, field, message string) {
+	p.errs = append(p.errs, FieldError{Field: field, Message: message})
+	p.details = append(p.details, detail)
+}
+
+// get returns the value of name, "" if it is absent. ok is false if it was
+// given more than once, which has been reported.
+func (p *queryParams) get(name string) (s string, ok bool) {
+	values := p.values[name]
+	if len(values) > 1 {
+		p.fail("Invalid "+name+" parameter", name, "must be given only once")
+		return "", false
+	}
+	return p.values.Get(name), true
+}
+
+// artistID reads a required artist ID.
+func (p *queryParams) artistID(name string) int {
+	s, ok := p.get(name)
+	if !ok {
+		return 0
+	}
+	if s == "" {
+		p.fail("Missing artist ID", name, "is required")
+		return 0
+	}
+	id, msg := parseArtistID(s)
+	if msg != "" {
+		p.fail("Invalid artist ID", name, msg)
+	}
+	return id
+}
+
+// parseArtistID parses an artist ID, returning why it is invalid if it is.
+func parseArtistID(s string) (int, string) {
+	id, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, "must be an integer"
+	}
+	if id < 1 || id > maxArtistID {
+		return 0, fmt.Sprintf("must be between 1 and %d", maxArtistID)
+	}
+	return id, ""
+}
+
+// searchQuery reads a required search query.
+func (p *queryParams) searchQuery(name string) string {
+	q, ok := p.get(name)
+	switch {
+	case !ok:
+	case strings.TrimSpace(q) == "":
+		p.fail("Search query is required", name, "is required")
+	case !utf8.ValidString(q):
+		p.fail("Invalid search query", name, "must be valid UTF-8")
+	case utf8.RuneCountInString(q) > maxQueryLength:
+		p.fail("Search query is too long", name, fmt.Sprintf("must be at most %d characters", maxQueryLength))
+	case strings.ContainsFunc(q, unicode.IsControl):
+		p.fail("Invalid search query", name, "must not contain control characters")
+	default:
+		return q
+	}
+	return ""
+}
+
+// artistIDs reads a required comma-separated list of at most maxItems
+// artist IDs, in the order given and without duplicates.
+func (p *queryParams) artistIDs(name string, maxItems int) []int {
+	before := len(p.errs)
+	items := p.list(name, maxItems)
+	if len(p.errs) > before {
+		return nil
+	}
+	if items == nil {
+		p.fail("Missing artist IDs", name, "is required")
+		return nil
+	}
+	var ids []int
+	for _, item := range items {
+		id, msg := parseArtistID(item)
+		if msg != "" {
+			p.fail("Invalid artist ID", name, fmt.Sprintf("%q %s", item, msg))
+			return nil
+		}
+		if !slices.Contains(ids, id) {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// list reads an optional comma-separated parameter whose items must be in
+// allowed, or anything if allowed is empty. At most maxItems may be given;
+// duplicates count towards the limit but are dropped.
+func (p *queryParams) list(name string, maxItems int, allowed ...string) []string {
+	s, ok := p.get(name)
+	if !ok || s == "" {
+		return nil
+	}
+	parts := strings.Split(s, ",")
+	if len(parts) > maxItems {
+		p.fail("Invalid "+name+" parameter", name, fmt.Sprintf("must have at most %d items", maxItems))
+		return nil
+	}
+	var items []string
+	for _, item := range parts {
+		switch {
+		case item == "":
+			p.fail("Invalid "+name+" parameter", name, "must not contain empty items")
+			return nil
+		case allowed != nil && !slices.Contains(allowed, item):
+			p.fail("Invalid "+name+" parameter", name, fmt.Sprintf("%q is not one of %s", item, strings.Join(allowed, ", ")))
+			return nil
+		case !slices.Contains(items, item):
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// problem returns the 400 problem describing every invalid parameter, or nil
+// if there is none.
+func (p *queryParams) problem() *Problem {
+	switch len(p.errs) {
+	case 0:
+		return nil
+	case 1:
+		return ValidationProblem(p.details[0], p.errs...)
+	default:
+		return ValidationProblem(fmt.Sprintf("%d request parameters are invalid", len(p.errs)), p.errs...)
+	}
+}
+
+// logInvalidParams records a request turned away by parameter validation.
+func logInvalidParams(ctx context.Context, p *Problem) {
+	slog.InfoContext(ctx, "Invalid request parameters", "detail", p.Detail, "errors", p.Errors)
+}
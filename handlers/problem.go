@@ -0,0 +1,121 @@
+package groupie
+
+import (
+	"log/slog"
+	"net/http"
+)
+
+// Problem types used by the handlers. Anything without a more specific type
+// uses "about:blank", whose title is the HTTP status text.
+const (
+	ProblemTypeBlank      = "about:blank"
+	ProblemTypeValidation = "/problems/validation-error"
+)
+
+// Problem is an RFC 7807 problem document. API routes return it as
+// application/problem+json; browser routes render it with error.html unless
+// the client asks for JSON.
+type Problem struct {
+	Type     string       `json:"type"`
+	Title    string       `json:"title"`
+	Status   int          `json:"status"`
+	Detail   string       `json:"detail,omitempty"`
+	Instance string       `json:"instance,omitempty"`
+	Errors   []FieldError `json:"errors,omitempty"`
+	// RequestID lets a user quote the request when reporting the problem.
+	RequestID string `json:"requestId,omitempty"`
+}
+
+// FieldError describes why a single request parameter was rejected.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// NewProblem returns an about:blank problem for the given status code.
+func NewProblem(status int, detail string) *Problem {
+	return &Problem{
+		Type:   ProblemTypeBlank,
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: detail,
+	}
+}
+
+// ValidationProblem returns a 400 problem carrying field-level errors.
+func ValidationProblem(detail string, errors ...FieldError) *Problem {
+	return &Problem{
+		Type:   ProblemTypeValidation,
+		Title:  "Invalid request parameters",
+		Status: http.StatusBadRequest,
+		Detail: detail,
+		Errors: errors,
+	}
+}
+
+// ErrorData is the data passed to error.html.
+type ErrorData struct {
+	Code      int
+	Title     string
+	Errors    []string
+	RequestID string
+	Nonce     string
+}
+
+// WriteJSONProblem sends p as application/problem+json. API handlers use it
+// for every error, whatever the client accepts.
+func WriteJSONProblem(w http.ResponseWriter, r *http.Request, p *Problem) {
+	if p.Instance == "" {
+		p.Instance = r.URL.RequestURI()
+	}
+	if p.RequestID == "" {
+		p.RequestID = RequestIDFrom(r.Context())
+	}
+	if err := writeJSON(w, p.Status, "application/problem+json", p); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to encode problem document", "error", err)
+	}
+}
+
+// WriteProblem sends p to a browser route's client: as a problem document if
+// it prefers JSON, as the error page otherwise.
+func WriteProblem(w http.ResponseWriter, r *http.Request, p *Problem) {
+	if prefersJSON(r) {
+		WriteJSONProblem(w, r, p)
+		return
+	}
+
+	data := ErrorData{Code: p.Status, Title: p.Title, RequestID: RequestIDFrom(r.Context()), Nonce: CSPNonce(r.Context())}
+	if p.Detail != "" {
+		data.Errors = append(data.Errors, p.Detail)
+	}
+	for _, fe := range p.Errors {
+		data.Errors = append(data.Errors, fe.Field+": "+fe.Message)
+	}
+	page, err := renderPage("error.html", data)
+	if err != nil {
+		// Log the error and write a generic message if the template fails
+		slog.ErrorContext(r.Context(), "Failed to render error template", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	// Set the response status code only if the template rendered
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(p.Status)
+	if _, err := w.Write(page); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to write error page", "error", err)
+	}
+}
+
+// methodNotAllowed rejects a request whose method the route does not serve.
+func methodNotAllowed(w http.ResponseWriter, r *http.Request, allowed string) {
+	slog.InfoContext(r.Context(), "Invalid method", "method", r.Method)
+	w.Header().Set("Allow", allowed)
+	WriteProblem(w, r, NewProblem(http.StatusMethodNotAllowed, "Invalid method"))
+}
+
+// methodNotAllowedJSON is methodNotAllowed for API routes.
+func methodNotAllowedJSON(w http.ResponseWriter, r *http.Request, allowed string) {
+	slog.InfoContext(r.Context(), "Invalid method", "method", r.Method)
+	w.Header().Set("Allow", allowed)
+	WriteJSONProblem(w, r, NewProblem(http.StatusMethodNotAllowed, "Invalid method"))
+}
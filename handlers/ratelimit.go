@@ -0,0 +1,98 @@
+package groupie
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// tokenBucket is a token bucket refilled at rate tokens per second, holding at
+// most burst tokens.
+type tokenBucket struct {
+	rate  float64
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst)}
+}
+
+// refill adds the tokens earned since the last call. b.mu must be held.
+func (b *tokenBucket) refill(now time.Time) {
+	if !b.last.IsZero() {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+}
+
+// reserve takes a token, going into debt if none is left, and returns how long
+// the caller must wait before using it.
+func (b *tokenBucket) reserve(now time.Time) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(now)
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// allow takes a token if one is available. Otherwise it leaves the bucket as
+// it is and returns how long until one will be.
+func (b *tokenBucket) allow(now time.Time) (bool, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(now)
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// full reports whether the bucket has refilled completely, so that dropping
+// it changes nothing for its client.
+func (b *tokenBucket) full(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(now)
+	return b.tokens >= b.burst
+}
+
+// wait blocks until a token is available or ctx is done.
+func (b *tokenBucket) wait(ctx context.Context) error {
+	return sleep(ctx, b.reserve(time.Now()))
+}
+
+// hostLimiter keeps one token bucket per host.
+type hostLimiter struct {
+	rate  float64
+	burst int
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+func newHostLimiter(rate float64, burst int) *hostLimiter {
+	return &hostLimiter{rate: rate, burst: burst, buckets: make(map[string]*tokenBucket)}
+}
+
+// wait blocks until host may be sent another request or ctx is done.
+func (l *hostLimiter) wait(ctx context.Context, host string) error {
+	l.mu.Lock()
+	b, ok := l.buckets[host]
+	if !ok {
+		b = newTokenBucket(l.rate, l.burst)
+		l.buckets[host] = b
+	}
+	l.mu.Unlock()
+	return b.wait(ctx)
+}
@@ -0,0 +1,122 @@
+package groupie
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
+	"sync"
+	"time"
+)
+
+// Pages rendered by the handlers. Each one is parsed together with the shared
+// layout and partials, so a page only defines the blocks it overrides.
+var pageNames = []string{"index.html", "artist.html", "error.html"}
+
+// TemplateSet holds the parsed page templates.
+type TemplateSet struct {
+	fsys fs.FS
+	dev  bool
+
+	mu       sync.RWMutex
+	pages    map[string]*template.Template
+	parsedAt time.Time
+}
+
+// templates is the set used by the handlers, loaded once at startup.
+var templates *TemplateSet
+
+// IndexData is the data passed to index.html.
+type IndexData struct {
+	Artists []Artist
+	Nonce   string
+}
+
+// LoadTemplates parses every page from fsys and makes the set available to
+// the handlers. In dev mode the set is re-parsed whenever a file changes.
+func LoadTemplates(fsys fs.FS, dev bool) error {
+	ts, err := NewTemplateSet(fsys, dev)
+	if err != nil {
+		return err
+	}
+	templates = ts
+	return nil
+}
+
+// NewTemplateSet parses the layout, partials and pages found in fsys.
+func NewTemplateSet(fsys fs.FS, dev bool) (*TemplateSet, error) {
+	ts := &TemplateSet{fsys: fsys, dev: dev}
+	if err := ts.parse(); err != nil {
+		return nil, err
+	}
+	return ts, nil
+}
+
+func (ts *TemplateSet) parse() error {
+	pages := make(map[string]*template.Template, len(pageNames))
+	for _, name := range pageNames {
+		tmpl, err := template.New(name).ParseFS(ts.fsys, "layout.html", "partials/*.html", name)
+		if err != nil {
+			return fmt.Errorf("failed to parse template %s: %w", name, err)
+		}
+		pages[name] = tmpl
+	}
+
+	ts.mu.Lock()
+	ts.pages = pages
+	ts.parsedAt = time.Now()
+	ts.mu.Unlock()
+	return nil
+}
+
+// changedSince reports whether any template file was modified after t.
+func (ts *TemplateSet) changedSince(t time.Time) bool {
+	changed := false
+	fs.WalkDir(ts.fsys, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		if info, err := d.Info(); err == nil && info.ModTime().After(t) {
+			changed = true
+			return fs.SkipAll
+		}
+		return nil
+	})
+	return changed
+}
+
+// Render executes the named page into w.
+func (ts *TemplateSet) Render(w io.Writer, name string, data any) error {
+	ts.mu.RLock()
+	parsedAt := ts.parsedAt
+	ts.mu.RUnlock()
+	if ts.dev && ts.changedSince(parsedAt) {
+		if err := ts.parse(); err != nil {
+			return err
+		}
+	}
+
+	ts.mu.RLock()
+	tmpl, ok := ts.pages[name]
+	ts.mu.RUnlock()
+	if !ok {
+		return fmt.Errorf("unknown template %s", name)
+	}
+
+	return tmpl.ExecuteTemplate(w, "layout", data)
+}
+
+// renderPage renders a page from the set loaded by LoadTemplates into memory,
+// so a failing template never leaves a half-written response.
+func renderPage(name string, data any) ([]byte, error) {
+	if templates == nil {
+		return nil, errors.New("templates not loaded")
+	}
+	var buf bytes.Buffer
+	if err := templates.Render(&buf, name, data); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,406 @@
+package groupie
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Base URL of the groupietrackers API the artist data is fetched from.
+const DefaultUpstreamBaseURL = "https://groupietrackers.herokuapp.com/api"
+
+// ErrCircuitOpen is returned without calling the API while the circuit
+// breaker is open. It is classified as upstream unavailable.
+var ErrCircuitOpen = errors.New("circuit breaker open")
+
+// UpstreamClient fetches JSON from the groupietrackers API. Failed requests
+// are retried with jittered exponential backoff, and the circuit breaker makes
+// callers fail fast while the API is down.
+type UpstreamClient struct {
+	BaseURL    string
+	HTTPClient *http.Client
+
+	// MaxRetries is the number of extra attempts after a failed request.
+	MaxRetries int
+	// BaseBackoff is the delay before the first retry; it doubles on every
+	// further retry up to MaxBackoff.
+	BaseBackoff time.Duration
+	MaxBackoff  time.Duration
+
+	Breaker *CircuitBreaker
+
+	limiter *hostLimiter
+
+	// Last 200 response per URL, replayed when the upstream answers 304
+	responsesMu sync.Mutex
+	responses   map[string]*cachedResponse
+}
+
+// upstream is the client shared by the handlers and the cache.
+var upstream = NewUpstreamClient(DefaultUpstreamBaseURL, 20*time.Second)
+
+// SetUpstreamClient replaces the client used by the handlers and the cache,
+// returning the previous one.
+func SetUpstreamClient(c *UpstreamClient) *UpstreamClient {
+	previous := upstream
+	upstream = c
+	return previous
+}
+
+// NewUpstreamClient returns a client for baseURL with the default retry and
+// circuit breaker settings. timeout bounds each attempt, body included.
+func NewUpstreamClient(baseURL string, timeout time.Duration) *UpstreamClient {
+	return &UpstreamClient{
+		BaseURL:     baseURL,
+		HTTPClient:  &http.Client{Timeout: timeout},
+		MaxRetries:  2,
+		BaseBackoff: 200 * time.Millisecond,
+		MaxBackoff:  2 * time.Second,
+		Breaker:     NewCircuitBreaker(5, 30*time.Second),
+		limiter:     newHostLimiter(10, 10),
+	}
+}
+
+// SetRateLimit limits requests to rate per second for each host, allowing
+// bursts of up to burst requests. A rate of zero or less removes the limit.
+func (c *UpstreamClient) SetRateLimit(rate float64, burst int) {
+	if rate <= 0 {
+		c.limiter = nil
+		return
+	}
+	c.limiter = newHostLimiter(rate, max(burst, 1))
+}
+
+// URL returns the absolute URL of an API path such as "/artists".
+func (c *UpstreamClient) URL(path string) string {
+	return c.BaseURL + path
+}
+
+// GetJSON GETs url and decodes the JSON body into v. Failures are returned as
+// an *Error classified as upstream unavailable, timeout or malformed.
+func (c *UpstreamClient) GetJSON(ctx context.Context, url string, v any) error {
+	modified, err := c.GetJSONIfModified(ctx, url, v)
+	if err == nil && !modified {
+		err = c.DecodeCached(url, v)
+	}
+	return err
+}
+
+// GetJSONIfModified is GetJSON as a conditional request: it sends the ETag
+// and Last-Modified of the previous response for url and reports whether the
+// resource changed. When it did not, v is left untouched; DecodeCached fills
+// it from the previous response if the caller needs it after all.
+func (c *UpstreamClient) GetJSONIfModified(ctx context.Context, url string, v any) (bool, error) {
+	resp, err := c.getJSON(ctx, url, v)
+	return resp != nil, err
+}
+
+// getJSON is GetJSONIfModified returning the response v was decoded from, or
+// nil if the resource did not change.
+func (c *UpstreamClient) getJSON(ctx context.Context, url string, v any) (*cachedResponse, error) {
+	if !c.Breaker.Allow() {
+		slog.WarnContext(ctx, "Upstream circuit open, request rejected", logUpstreamURL, url)
+		err := &Error{Kind: ErrUpstreamUnavailable, Err: fmt.Errorf("GET %s: %w", url, ErrCircuitOpen)}
+		observeUpstream(url, 0, err)
+		return nil, err
+	}
+
+	start := time.Now()
+	var resp *cachedResponse
+	var err error
+	attempts := 0
+	for attempt := 0; ; attempt++ {
+		attempts++
+		resp, err = c.get(ctx, url)
+		if err == nil || !retryable(err) || attempt >= c.MaxRetries {
+			break
+		}
+		backoff := c.backoff(attempt)
+		slog.WarnContext(ctx, "Upstream request failed, retrying", logUpstreamURL, url, "attempt", attempts, "backoff", backoff, "error", err)
+		if sleep(ctx, backoff) != nil {
+			break
+		}
+	}
+
+	modified := resp != nil
+	if err == nil && modified {
+		if jsonErr := json.Unmarshal(resp.body, v); jsonErr != nil {
+			err = &Error{Kind: ErrUpstreamMalformed, Err: fmt.Errorf("GET %s: %w", url, jsonErr)}
+		} else {
+			c.storeResponse(url, resp)
+		}
+	}
+
+	c.record(ctx, url, err)
+	observeUpstream(url, time.Since(start), err)
+	switch {
+	case errors.Is(err, context.Canceled):
+		slog.DebugContext(ctx, "Upstream request canceled", logUpstreamURL, url, logDuration, time.Since(start))
+	case err != nil:
+		slog.WarnContext(ctx, "Upstream request failed", logUpstreamURL, url, "attempts", attempts, logDuration, time.Since(start), "error", err)
+	default:
+		slog.DebugContext(ctx, "Upstream request", logUpstreamURL, url, "modified", modified, "attempts", attempts, logDuration, time.Since(start))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// DecodeCached decodes the last successful response for url into v.
+func (c *UpstreamClient) DecodeCached(url string, v any) error {
+	resp := c.cachedResponse(url)
+	if resp == nil {
+		return fmt.Errorf("no cached response for %s", url)
+	}
+	return json.Unmarshal(resp.body, v)
+}
+
+// cachedResponse is the body of a 200 response with its validators.
+type cachedResponse struct {
+	etag         string
+	lastModified string
+	body         []byte
+}
+
+func (c *UpstreamClient) cachedResponse(url string) *cachedResponse {
+	c.responsesMu.Lock()
+	defer c.responsesMu.Unlock()
+	return c.responses[url]
+}
+
+func (c *UpstreamClient) storeResponse(url string, resp *cachedResponse) {
+	if resp.etag == "" && resp.lastModified == "" {
+		return
+	}
+	c.responsesMu.Lock()
+	defer c.responsesMu.Unlock()
+	if c.responses == nil {
+		c.responses = make(map[string]*cachedResponse)
+	}
+	c.responses[url] = resp
+}
+
+// get performs a single attempt. It returns nil without an error when the
+// upstream answers 304 Not Modified.
+func (c *UpstreamClient) get(ctx context.Context, url string) (*cachedResponse, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	// Let the upstream correlate its logs with ours
+	if id := RequestIDFrom(ctx); id != "" {
+		req.Header.Set(RequestIDHeader, id)
+	}
+	if cached := c.cachedResponse(url); cached != nil {
+		if cached.etag != "" {
+			req.Header.Set("If-None-Match", cached.etag)
+		}
+		if cached.lastModified != "" {
+			req.Header.Set("If-Modified-Since", cached.lastModified)
+		}
+	}
+	if c.limiter != nil {
+		if err := c.limiter.wait(ctx, req.URL.Host); err != nil {
+			return nil, classifyTransportError(err)
+		}
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, classifyTransportError(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified && c.cachedResponse(url) != nil {
+		return nil, nil
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, &Error{Kind: ErrUpstreamUnavailable, Err: &statusError{url: url, code: resp.StatusCode}}
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, classifyTransportError(err)
+	}
+	return &cachedResponse{
+		etag:         resp.Header.Get("ETag"),
+		lastModified: resp.Header.Get("Last-Modified"),
+		body:         body,
+	}, nil
+}
+
+// record updates the circuit breaker. Only failures to reach the API count
+// against it: malformed data and rejected requests still prove it is up.
+func (c *UpstreamClient) record(ctx context.Context, url string, err error) {
+	if errors.Is(err, context.Canceled) {
+		c.Breaker.Abandon()
+		return
+	}
+	if errors.Is(err, ErrUpstreamTimeout) || (errors.Is(err, ErrUpstreamUnavailable) && retryable(err)) {
+		c.Breaker.Failure()
+		if c.Breaker.State() == CircuitOpen {
+			slog.WarnContext(ctx, "Upstream circuit open", logUpstreamURL, url, "cooldown", c.Breaker.Cooldown)
+		}
+	} else {
+		c.Breaker.Success()
+	}
+}
+
+// backoff returns the jittered delay before retry number attempt+1.
+func (c *UpstreamClient) backoff(attempt int) time.Duration {
+	d := c.BaseBackoff << attempt
+	if d <= 0 || d > c.MaxBackoff {
+		d = c.MaxBackoff
+	}
+	// Equal jitter in [d/2, d] spreads out retries from concurrent callers
+	half := d / 2
+	return half + rand.N(half+1)
+}
+
+// sleep waits for d or until ctx is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// statusError is a non-2xx response from the API.
+type statusError struct {
+	url  string
+	code int
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("GET %s returned %d %s", e.url, e.code, http.StatusText(e.code))
+}
+
+// retryable reports whether another attempt might succeed: network failures,
+// timeouts, 5xx responses and 429 are retried, other responses are not.
+func retryable(err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+	var se *statusError
+	if errors.As(err, &se) {
+		return se.code >= 500 || se.code == http.StatusTooManyRequests
+	}
+	return errors.Is(err, ErrUpstreamUnavailable) || errors.Is(err, ErrUpstreamTimeout)
+}
+
+// classifyTransportError tells timeouts apart from other network failures.
+func classifyTransportError(err error) error {
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return &Error{Kind: ErrUpstreamTimeout, Err: err}
+	}
+	return &Error{Kind: ErrUpstreamUnavailable, Err: err}
+}
+
+// fetchJSON GETs url with the shared upstream client.
+func fetchJSON(ctx context.Context, url string, v any) error {
+	return upstream.GetJSON(ctx, url, v)
+}
+
+// Circuit breaker states.
+const (
+	CircuitClosed   = "closed"
+	CircuitOpen     = "open"
+	CircuitHalfOpen = "half-open"
+)
+
+// CircuitBreaker opens after Threshold consecutive failures and rejects calls
+// for Cooldown. After that it lets a single probe call through, rejecting the
+// others until it returns: a success closes it, a failure opens it for
+// another Cooldown.
+type CircuitBreaker struct {
+	Threshold int
+	Cooldown  time.Duration
+
+	mu       sync.Mutex
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+// NewCircuitBreaker returns a closed circuit breaker.
+func NewCircuitBreaker(threshold int, cooldown time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{Threshold: threshold, Cooldown: cooldown}
+}
+
+func (b *CircuitBreaker) state() string {
+	switch {
+	case b.failures < b.Threshold:
+		return CircuitClosed
+	case time.Since(b.openedAt) < b.Cooldown:
+		return CircuitOpen
+	default:
+		return CircuitHalfOpen
+	}
+}
+
+// State returns CircuitClosed, CircuitOpen or CircuitHalfOpen.
+func (b *CircuitBreaker) State() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state()
+}
+
+// Allow reports whether a call may go ahead. Every allowed call must end
+// with Success, Failure or Abandon.
+func (b *CircuitBreaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state() {
+	case CircuitClosed:
+		return true
+	case CircuitHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	default:
+		return false
+	}
+}
+
+// Success records a call that reached the API.
+func (b *CircuitBreaker) Success() {
+	b.mu.Lock()
+	b.failures = 0
+	b.probing = false
+	b.mu.Unlock()
+}
+
+// Failure records a call that could not reach the API.
+func (b *CircuitBreaker) Failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	b.failures++
+	if b.failures >= b.Threshold {
+		b.openedAt = time.Now()
+	}
+}
+
+// Abandon records a call that ended without telling whether the API is up,
+// so another call may probe it.
+func (b *CircuitBreaker) Abandon() {
+	b.mu.Lock()
+	b.probing = false
+	b.mu.Unlock()
+}
@@ -0,0 +1,187 @@
+package groupie
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+)
+
+// Upstream resources checked by the validation layer.
+const (
+	ResourceArtists   = "artists"
+	ResourceLocations = "locations"
+	ResourceDates     = "dates"
+	ResourceRelations = "relation"
+)
+
+var validatedResources = []string{ResourceArtists, ResourceLocations, ResourceDates, ResourceRelations}
+
+// RecordIssue is a problem found in a single upstream record.
+type RecordIssue struct {
+	Resource string `json:"resource"`
+	ID       int    `json:"id"`
+	Field    string `json:"field,omitempty"`
+	Message  string `json:"message"`
+	// Rejected is set when the record was dropped rather than just reported.
+	Rejected bool `json:"rejected"`
+}
+
+// ResourceSummary counts the records received for one resource.
+type ResourceSummary struct {
+	Checked  int `json:"checked"`
+	Rejected int `json:"rejected"`
+}
+
+// ValidationSummary is the outcome of validating one refresh of the upstream
+// data, per resource and per record.
+type ValidationSummary struct {
+	Resources map[string]ResourceSummary `json:"resources"`
+	Issues    []RecordIssue              `json:"issues,omitempty"`
+}
+
+func (s *ValidationSummary) checked(resource string, n int) {
+	if s.Resources == nil {
+		s.Resources = make(map[string]ResourceSummary)
+	}
+	rs := s.Resources[resource]
+	rs.Checked += n
+	s.Resources[resource] = rs
+}
+
+// reject records an issue that caused the record to be dropped.
+func (s *ValidationSummary) reject(resource string, id int, field, message string) {
+	rs := s.Resources[resource]
+	rs.Rejected++
+	s.Resources[resource] = rs
+	s.Issues = append(s.Issues, RecordIssue{Resource: resource, ID: id, Field: field, Message: message, Rejected: true})
+}
+
+// warn records an issue that leaves the record in place.
+func (s *ValidationSummary) warn(resource string, id int, field, message string) {
+	s.Issues = append(s.Issues, RecordIssue{Resource: resource, ID: id, Field: field, Message: message})
+}
+
+// String summarises the counts, e.g. "artists 52/52 valid, locations 51/52 valid".
+func (s ValidationSummary) String() string {
+	var parts []string
+	for _, resource := range validatedResources {
+		if rs, ok := s.Resources[resource]; ok {
+			parts = append(parts, fmt.Sprintf("%s %d/%d valid", resource, rs.Checked-rs.Rejected, rs.Checked))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// log writes the summary and each issue found.
+func (s ValidationSummary) log(ctx context.Context) {
+	slog.InfoContext(ctx, "Upstream data validated", "summary", s.String(), "issues", len(s.Issues))
+	for _, issue := range s.Issues {
+		level := slog.LevelInfo
+		if issue.Rejected {
+			level = slog.LevelWarn
+		}
+		slog.Log(ctx, level, "Upstream record issue",
+			"resource", issue.Resource, logArtistID, issue.ID, "field", issue.Field, "message", issue.Message, "rejected", issue.Rejected)
+	}
+}
+
+// checkID rejects non-positive and duplicate IDs. seen tracks the IDs accepted
+// so far for the resource.
+func (s *ValidationSummary) checkID(resource string, id int, seen map[int]bool) bool {
+	if id <= 0 {
+		s.reject(resource, id, "id", "must be a positive integer")
+		return false
+	}
+	if seen[id] {
+		s.reject(resource, id, "id", "is duplicated")
+		return false
+	}
+	seen[id] = true
+	return true
+}
+
+// validateArtists returns the artists with an ID and a name, each ID once.
+func validateArtists(artists []Artist, s *ValidationSummary) []Artist {
+	s.checked(ResourceArtists, len(artists))
+	seen := make(map[int]bool, len(artists))
+	valid := make([]Artist, 0, len(artists))
+	for _, artist := range artists {
+		if strings.TrimSpace(artist.Name) == "" {
+			s.reject(ResourceArtists, artist.ID, "name", "is required")
+			continue
+		}
+		if !s.checkID(ResourceArtists, artist.ID, seen) {
+			continue
+		}
+		valid = append(valid, artist)
+	}
+	return valid
+}
+
+// validateLocations returns the location entries with a unique ID.
+func validateLocations(index []LocationEntry, s *ValidationSummary) []LocationEntry {
+	s.checked(ResourceLocations, len(index))
+	seen := make(map[int]bool, len(index))
+	valid := make([]LocationEntry, 0, len(index))
+	for _, entry := range index {
+		if s.checkID(ResourceLocations, entry.ID, seen) {
+			valid = append(valid, entry)
+		}
+	}
+	return valid
+}
+
+// validateDates returns the date entries with a unique ID.
+func validateDates(index []DateEntry, s *ValidationSummary) []DateEntry {
+	s.checked(ResourceDates, len(index))
+	seen := make(map[int]bool, len(index))
+	valid := make([]DateEntry, 0, len(index))
+	for _, entry := range index {
+		if s.checkID(ResourceDates, entry.ID, seen) {
+			valid = append(valid, entry)
+		}
+	}
+	return valid
+}
+
+// validateRelations returns the relation entries with a unique ID.
+func validateRelations(index []RelationEntry, s *ValidationSummary) []RelationEntry {
+	s.checked(ResourceRelations, len(index))
+	seen := make(map[int]bool, len(index))
+	valid := make([]RelationEntry, 0, len(index))
+	for _, entry := range index {
+		if s.checkID(ResourceRelations, entry.ID, seen) {
+			valid = append(valid, entry)
+		}
+	}
+	return valid
+}
+
+// crossCheck reports artists missing from one of the indexes, and index
+// entries that belong to no artist. Each map holds the IDs present in that
+// resource.
+func crossCheck(artists []Artist, ids map[string]map[int]bool, s *ValidationSummary) {
+	artistIDs := make(map[int]bool, len(artists))
+	for _, artist := range artists {
+		artistIDs[artist.ID] = true
+		for _, resource := range validatedResources[1:] {
+			if present, ok := ids[resource]; ok && !present[artist.ID] {
+				s.warn(ResourceArtists, artist.ID, resource, "has no matching "+resource+" entry")
+			}
+		}
+	}
+	for _, resource := range validatedResources[1:] {
+		var orphans []int
+		for id := range ids[resource] {
+			if !artistIDs[id] {
+				orphans = append(orphans, id)
+			}
+		}
+		sort.Ints(orphans)
+		for _, id := range orphans {
+			s.warn(resource, id, "id", "matches no artist")
+		}
+	}
+}
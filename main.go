@@ -1,31 +1,220 @@
 package main
 
 import (
+	"cmp"
+	"context"
 	"errors"
+	"flag"
 	"fmt"
-	"log"
+	"io/fs"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
+	"groupie/config"
 	handlers "groupie/handlers"
 )
 
 func main() {
-	fs := http.FileServer(http.Dir("static"))
-	http.Handle("/static/", http.StripPrefix("/static/", fs))
+	cfg, err := config.Load(os.Args[1:], os.LookupEnv)
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	level, err := handlers.ParseLogLevel(cfg.LogLevel)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	logger, err := handlers.NewLogger(os.Stderr, cfg.LogFormat, level)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	slog.SetDefault(logger)
+	slog.Info("Effective configuration", "config", cfg)
+	configureHandlers(cfg)
 
-	// Use the handler function for routing
-	http.HandleFunc("/", handler)
-	port := ":8080"
-	log.Printf("Server started on http://localhost%s", port)
+	assets := assetFS(cfg.AssetsDir)
 
-	err := http.ListenAndServe(port, nil)
-	if errors.Is(err, http.ErrServerClosed) {
-		fmt.Printf("server closed\n")
-	} else if err != nil {
-		fmt.Printf("error starting server: %s\n", err)
+	templatesFS, err := fs.Sub(assets, "templates")
+	if err != nil {
+		slog.Error("Failed to load templates", "error", err)
+		os.Exit(1)
+	}
+	// Parse the templates once so a missing templates/ directory fails at startup
+	if err := handlers.LoadTemplates(templatesFS, cfg.Dev); err != nil {
+		slog.Error("Failed to load templates", "error", err)
+		os.Exit(1)
+	}
+
+	staticFS, err := fs.Sub(assets, "static")
+	if err != nil {
+		slog.Error("Failed to load static files", "error", err)
+		os.Exit(1)
+	}
+	staticServer := http.FileServer(http.FS(staticFS))
+	http.Handle("/static/", http.StripPrefix("/static/", handlers.CacheStatic(staticFS, staticServer)))
+
+	// Use the handler function for routing. Pages and the JSON API share
+	// URLs, so the CORS policy covers every route but static files. Rate
+	// limiting comes after it so that cross-origin clients can read a 429.
+	cors := handlers.CORS(handlers.CORSOptions{AllowedOrigins: cfg.CORSOrigins, MaxAge: cfg.CORSMaxAge})
+	limits := handlers.RateLimiter(handlers.RateLimitOptions{
+		Search:         handlers.RateLimit{Rate: cfg.SearchRateLimit, Burst: cfg.SearchBurst},
+		API:            handlers.RateLimit{Rate: cfg.APIRateLimit, Burst: cfg.APIBurst},
+		TrustedProxies: cfg.TrustedProxyPrefixes(),
+	})
+	http.Handle("/", handlers.Chain(http.HandlerFunc(handler), cors, limits))
+
+	// SIGINT and SIGTERM start a graceful shutdown
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if cfg.TLS && cfg.TLSCert == "" {
+		// Validation only lets this through in dev mode
+		cfg.TLSCert, cfg.TLSKey, err = devCertificate(devCertDir, time.Now())
+		if err != nil {
+			slog.Error("Failed to create the development certificate", "error", err)
+			os.Exit(1)
+		}
+		slog.Warn("Serving a self-signed development certificate", "cert", cfg.TLSCert)
+	}
+
+	var lns listeners
+	lns.Main, err = net.Listen("tcp", cfg.Addr())
+	if err != nil {
+		slog.Error("Failed to start server", "error", err)
+		os.Exit(1)
+	}
+	scheme := "http"
+	if cfg.TLS {
+		scheme = "https"
+	}
+	slog.Info("Server started", "addr", lns.Main.Addr().String(), "scheme", scheme)
+	if cfg.RedirectPort > 0 {
+		lns.Redirect, err = net.Listen("tcp", net.JoinHostPort(cfg.Host, strconv.Itoa(cfg.RedirectPort)))
+		if err != nil {
+			slog.Error("Failed to start the HTTPS redirect listener", "error", err)
+			os.Exit(1)
+		}
+		slog.Info("Redirecting HTTP to HTTPS", "addr", lns.Redirect.Addr().String())
+	}
+	security := handlers.SecurityOptions{CSP: cfg.CSP, CSPReportOnly: cfg.CSPReportOnly}
+	if cfg.TLS && !cfg.Dev {
+		// HSTS would pin every port of localhost to HTTPS in dev mode
+		security.HSTSMaxAge = cfg.HSTSMaxAge
+	}
+	h := handlers.Chain(http.DefaultServeMux, handlers.RequestID, handlers.SecurityHeaders(security), handlers.Metrics, handlers.AccessLog, handlers.Compress, handlers.Recover)
+	if err := run(ctx, cfg, lns, h); err != nil {
+		slog.Error("Server stopped", "error", err)
 		os.Exit(1)
 	}
+	slog.Info("Server stopped")
+}
+
+// configureHandlers applies the upstream and cache settings.
+func configureHandlers(cfg config.Config) {
+	client := handlers.NewUpstreamClient(cfg.UpstreamURL, cfg.UpstreamTimeout)
+	client.MaxRetries = cfg.UpstreamRetries
+	client.SetRateLimit(cfg.UpstreamRateLimit, cfg.UpstreamBurst)
+	handlers.SetUpstreamClient(client)
+	handlers.SetLocationFetchOptions(handlers.LocationFetchOptions{BulkIndex: cfg.BulkLocations, Workers: cfg.LocationWorkers})
+	handlers.SetCacheDuration(cfg.CacheDuration)
+	// Leave a quarter of the write timeout to answer when a refresh times out
+	handlers.SetRefreshTimeout(cfg.WriteTimeout - cfg.WriteTimeout/4)
+	handlers.SetReadyMaxCacheAge(cfg.ReadyMaxCacheAge)
+}
+
+func newServer(cfg config.Config, h http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              cfg.Addr(),
+		Handler:           h,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		ReadTimeout:       cfg.ReadTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+		MaxHeaderBytes:    cfg.MaxHeaderBytes,
+	}
+}
+
+// listeners are the sockets run serves on. Redirect is nil unless plain
+// HTTP requests are redirected to HTTPS.
+type listeners struct {
+	Main     net.Listener
+	Redirect net.Listener
+}
+
+// run serves h on lns.Main, over TLS if cfg.TLS is set, with the cache
+// refresher alongside, until ctx is done. It then stops accepting
+// connections, stops the refresher and waits up to cfg.ShutdownTimeout for
+// in-flight requests before closing what is left.
+func run(ctx context.Context, cfg config.Config, lns listeners, h http.Handler) error {
+	servers := []*http.Server{newServer(cfg, h)}
+	serve := []func() error{func() error { return servers[0].Serve(lns.Main) }}
+	if cfg.TLS {
+		servers[0].TLSConfig = tlsConfig()
+		serve[0] = func() error { return servers[0].ServeTLS(lns.Main, cfg.TLSCert, cfg.TLSKey) }
+	}
+	if lns.Redirect != nil {
+		redirect := newServer(cfg, redirectToHTTPS(lns.Main.Addr().(*net.TCPAddr).Port))
+		servers = append(servers, redirect)
+		serve = append(serve, func() error { return redirect.Serve(lns.Redirect) })
+	}
+
+	refreshCtx, stopRefresh := context.WithCancel(ctx)
+	defer stopRefresh()
+	refreshed := make(chan struct{})
+	go func() {
+		defer close(refreshed)
+		handlers.RefreshCache(refreshCtx, cfg.RefreshInterval)
+	}()
+
+	served := make(chan error, len(serve))
+	for _, fn := range serve {
+		go func() { served <- fn() }()
+	}
+	running := len(serve)
+
+	var err error
+	select {
+	case err = <-served:
+		// A listener failed; take the others down with it
+		running--
+	case <-ctx.Done():
+		slog.Info("Shutting down, draining in-flight requests", "timeout", cfg.ShutdownTimeout)
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	for _, server := range servers {
+		if shutdownErr := server.Shutdown(shutdownCtx); shutdownErr != nil {
+			// Requests still running past the deadline are cut off
+			server.Close()
+			err = cmp.Or(err, shutdownErr)
+		}
+	}
+	stopRefresh()
+	<-refreshed
+	for ; running > 0; running-- {
+		if serveErr := <-served; !errors.Is(serveErr, http.ErrServerClosed) {
+			err = cmp.Or(err, serveErr)
+		}
+	}
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
 }
 
 func handler(w http.ResponseWriter, r *http.Request) {
@@ -42,7 +231,19 @@ func handler(w http.ResponseWriter, r *http.Request) {
 		handlers.SearchHandler(w, r)
 	case "/getArtists":
 		handlers.FilteredArtistsHandler(w, r)
+	case "/api/v1/artists":
+		handlers.BatchArtistsHandler(w, r)
+	case "/metrics":
+		handlers.MetricsHandler(w, r)
+	case "/healthz":
+		handlers.HealthHandler(w, r)
+	case "/readyz":
+		handlers.ReadyHandler(w, r)
 	default:
-		handlers.ErrorHandler(w, r, http.StatusNotFound, []string{"Page not found"})
+		if strings.HasPrefix(r.URL.Path, "/artist/") {
+			handlers.ArtistHandler(w, r)
+			return
+		}
+		handlers.WriteProblem(w, r, handlers.NewProblem(http.StatusNotFound, "Page not found"))
 	}
 }
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"groupie/config"
+	handlers "groupie/handlers"
+)
+
+func TestRunShutsDownGracefully(t *testing.T) {
+	// The refresher polls a mock API; shutdown must stop it
+	var upstreamCalls atomic.Int32
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamCalls.Add(1)
+		switch r.URL.Path {
+		case "/artists":
+			io.WriteString(w, `[{"id": 1, "name": "Queen"}]`)
+		default:
+			io.WriteString(w, `{"index": []}`)
+		}
+	}))
+	defer api.Close()
+	defer handlers.SetUpstreamClient(handlers.SetUpstreamClient(handlers.NewUpstreamClient(api.URL, time.Second)))
+
+	started := make(chan struct{})
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(200 * time.Millisecond)
+		io.WriteString(w, "drained")
+	})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := config.Default()
+	cfg.ShutdownTimeout = 5 * time.Second
+	cfg.RefreshInterval = 10 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- run(ctx, cfg, listeners{Main: ln}, h) }()
+
+	// Shutting down before the first refresh reaches the API would prove nothing
+	for deadline := time.Now().Add(3 * time.Second); upstreamCalls.Load() == 0; time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("cache refresher never ran")
+		}
+	}
+
+	type result struct {
+		body string
+		err  error
+	}
+	responses := make(chan result, 1)
+	go func() {
+		resp, err := http.Get("http://" + ln.Addr().String() + "/")
+		if err != nil {
+			responses <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		responses <- result{string(body), err}
+	}()
+
+	// Shut down while the request is in flight
+	<-started
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("run returned %v, want nil", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("run did not return after shutdown")
+	}
+	if res := <-responses; res.err != nil || res.body != "drained" {
+		t.Errorf("in-flight request got %q, %v; want it drained", res.body, res.err)
+	}
+
+	if _, err := net.DialTimeout("tcp", ln.Addr().String(), time.Second); err == nil {
+		t.Error("server still accepts connections after shutdown")
+	}
+	calls := upstreamCalls.Load()
+	time.Sleep(50 * time.Millisecond)
+	if upstreamCalls.Load() != calls {
+		t.Error("cache refresher kept running after shutdown")
+	}
+}
+
+func TestNewServerAppliesConfig(t *testing.T) {
+	cfg := config.Default()
+	cfg.Host, cfg.Port = "127.0.0.1", 9090
+	cfg.ReadHeaderTimeout, cfg.ReadTimeout = time.Second, 2*time.Second
+	cfg.WriteTimeout, cfg.IdleTimeout = 3*time.Second, 4*time.Second
+	cfg.MaxHeaderBytes = 4096
+	s := newServer(cfg, http.NotFoundHandler())
+	if s.Addr != "127.0.0.1:9090" || s.ReadHeaderTimeout != time.Second || s.ReadTimeout != 2*time.Second ||
+		s.WriteTimeout != 3*time.Second || s.IdleTimeout != 4*time.Second || s.MaxHeaderBytes != 4096 {
+		t.Errorf("server does not match config: %+v", s)
+	}
+}
+
+func TestRunServesTLSAndRedirects(t *testing.T) {
+	// No upstream calls are expected; the refresher fails fast against a closed port
+	defer handlers.SetUpstreamClient(handlers.SetUpstreamClient(handlers.NewUpstreamClient("http://127.0.0.1:1", 100*time.Millisecond)))
+
+	certFile, keyFile, err := devCertificate(t.TempDir(), time.Now())
+	if err != nil {
+		t.Fatalf("devCertificate: %v", err)
+	}
+	cfg := config.Default()
+	cfg.TLS, cfg.TLSCert, cfg.TLSKey = true, certFile, keyFile
+	cfg.RefreshInterval = 0
+
+	var lns listeners
+	if lns.Main, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	if lns.Redirect, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, r.Proto) })
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- run(ctx, cfg, lns, h) }()
+	defer func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("run returned %v", err)
+		}
+	}()
+
+	pem, err := os.ReadFile(certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(pem)
+	client := &http.Client{
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}, ForceAttemptHTTP2: true},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	httpsAddr := lns.Main.Addr().String()
+
+	resp, err := client.Get("https://" + httpsAddr + "/")
+	if err != nil {
+		t.Fatalf("HTTPS request failed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.ProtoMajor != 2 || string(body) != "HTTP/2.0" {
+		t.Errorf("served over %s, handler saw %q; want HTTP/2", resp.Proto, body)
+	}
+
+	resp, err = client.Get("http://" + lns.Redirect.Addr().String() + "/search?q=queen")
+	if err != nil {
+		t.Fatalf("HTTP request failed: %v", err)
+	}
+	resp.Body.Close()
+	if want := "https://" + httpsAddr + "/search?q=queen"; resp.StatusCode != http.StatusPermanentRedirect || resp.Header.Get("Location") != want {
+		t.Errorf("redirect got %d to %q, want %d to %q", resp.StatusCode, resp.Header.Get("Location"), http.StatusPermanentRedirect, want)
+	}
+}
+
+func TestDevCertificate(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	certFile, keyFile, err := devCertificate(dir, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("generated pair does not load: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := leaf.VerifyHostname("localhost"); err != nil {
+		t.Errorf("certificate does not cover localhost: %v", err)
+	}
+	if info, err := os.Stat(keyFile); err != nil || info.Mode().Perm() != 0o600 {
+		t.Errorf("key file mode = %v, %v; want 0600", info.Mode().Perm(), err)
+	}
+
+	// A later run reuses the certificate until it is about to expire
+	before, _ := os.ReadFile(certFile)
+	devCertificate(dir, now.Add(time.Hour))
+	if after, _ := os.ReadFile(certFile); string(after) != string(before) {
+		t.Error("certificate was replaced while still valid")
+	}
+	devCertificate(dir, leaf.NotAfter.Add(-time.Hour))
+	if after, _ := os.ReadFile(certFile); string(after) == string(before) {
+		t.Error("certificate was not replaced before expiring")
+	}
+}
+
+func TestRedirectToHTTPS(t *testing.T) {
+	rr := httptest.NewRecorder()
+	redirectToHTTPS(8443).ServeHTTP(rr, httptest.NewRequest("GET", "http://example.com:8080/dates?id=1", nil))
+	if want := "https://example.com:8443/dates?id=1"; rr.Code != http.StatusPermanentRedirect || rr.Header().Get("Location") != want {
+		t.Errorf("got %d to %q, want %d to %q", rr.Code, rr.Header().Get("Location"), http.StatusPermanentRedirect, want)
+	}
+
+	req := httptest.NewRequest("GET", "/dates?id=1", nil)
+	req.Host = ""
+	rr = httptest.NewRecorder()
+	redirectToHTTPS(8443).ServeHTTP(rr, req)
+	if rr.Code != http.StatusBadRequest || rr.Header().Get("Location") != "" {
+		t.Errorf("request without a host got %d to %q, want 400", rr.Code, rr.Header().Get("Location"))
+	}
+}